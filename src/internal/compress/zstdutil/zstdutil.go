@@ -0,0 +1,149 @@
+package zstdutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// magic is zstd frame magic number
+	magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// decoders are synchronous (no goroutines), so they can be pooled
+	readerPool = sync.Pool{
+		New: func() interface{} {
+			z, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			if err != nil {
+				return err
+			}
+			return z
+		},
+	}
+
+	writerPool = sync.Pool{
+		New: func() interface{} {
+			z, err := zstd.NewWriter(ioutil.Discard, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+			if err != nil {
+				return err
+			}
+			return z
+		},
+	}
+)
+
+// GetReader gets reader from pool.
+func GetReader() (*zstd.Decoder, error) {
+	switch v := readerPool.Get().(type) {
+	case *zstd.Decoder:
+		return v, nil
+	case error:
+		return nil, v
+	}
+	return nil, fmt.Errorf("zstd: unreachable")
+}
+
+// PutReader releases source of reader and puts it back to the pool.
+func PutReader(z *zstd.Decoder) error {
+	if z == nil {
+		return nil
+	}
+
+	err := z.Reset(nil)
+	if err != nil {
+		return err
+	}
+
+	readerPool.Put(z)
+	return nil
+}
+
+// GetWriter gets writer from pool.
+func GetWriter() (*zstd.Encoder, error) {
+	switch v := writerPool.Get().(type) {
+	case *zstd.Encoder:
+		return v, nil
+	case error:
+		return nil, v
+	}
+	return nil, fmt.Errorf("zstd: unreachable")
+}
+
+// PutWriter closes writer, releases its destination and puts it back to the pool.
+func PutWriter(z *zstd.Encoder) error {
+	if z == nil {
+		return nil
+	}
+
+	err := z.Close()
+	if err != nil {
+		return err
+	}
+
+	z.Reset(ioutil.Discard)
+	writerPool.Put(z)
+	return nil
+}
+
+// Compress compresses bytes.
+func Compress(data []byte) ([]byte, error) {
+	w, err := GetWriter()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = PutWriter(w) }()
+
+	return w.EncodeAll(data, nil), nil
+}
+
+// MustCompress encodes bytes if not.
+func MustCompress(data []byte) ([]byte, error) {
+	if Detect(data) {
+		return data, nil
+	}
+
+	return Compress(data)
+}
+
+// Uncompress decompresses bytes.
+func Uncompress(data []byte) ([]byte, error) {
+	r, err := GetReader()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = PutReader(r) }()
+
+	return r.DecodeAll(data, nil)
+}
+
+// Copy reads and unzstds from Reader to Writer
+func Copy(dst io.Writer, src io.Reader) error {
+	r, err := GetReader()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = PutReader(r) }()
+
+	err = r.Reset(src)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// Detect returns true if data starts with zstd frame
+func Detect(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// InString returns true if zstd is mentioned in string
+func InString(s string) bool {
+	return strings.Contains(s, "zstd")
+}
@@ -0,0 +1,343 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:nadr"
+// HSET key SHA1(normalized name and address)->ID (SHA1 of addr link)
+// Index of normalized addresses, learned from rows linked by name,
+// links other notations of the same pharmacy or supplier.
+
+// addrParts is an address split into components
+type addrParts struct {
+	Region string `json:"region,omitempty"`
+	City   string `json:"city,omitempty"`
+	Type   string `json:"type,omitempty"` // street type (canonical)
+	Street string `json:"street,omitempty"`
+	House  string `json:"house,omitempty"` // "5", "5а", "5/7", "5к2"
+}
+
+// streetTypes maps UA/RU abbreviations of street types to canonical names
+var streetTypes = map[string]string{
+	"вул": "вулиця", "вулиця": "вулиця", "ул": "вулиця", "улица": "вулиця",
+	"просп": "проспект", "пр-т": "проспект", "пр-кт": "проспект", "пр": "проспект", "проспект": "проспект",
+	"пров": "провулок", "провулок": "провулок", "пер": "провулок", "переулок": "провулок",
+	"бул": "бульвар", "бульв": "бульвар", "б-р": "бульвар", "б-в": "бульвар", "бульвар": "бульвар",
+	"пл": "площа", "площа": "площа", "площадь": "площа",
+	"наб": "набережна", "набережна": "набережна", "набережная": "набережна",
+	"ш": "шосе", "шосе": "шосе", "шоссе": "шосе",
+	"мкр": "мікрорайон", "мкрн": "мікрорайон", "м-н": "мікрорайон", "мікрорайон": "мікрорайон", "микрорайон": "мікрорайон",
+	"жм": "масив", "масив": "масив", "массив": "масив",
+	"узвіз": "узвіз", "спуск": "узвіз",
+	"пр-д": "проїзд", "проїзд": "проїзд", "проезд": "проїзд",
+	"алея": "алея", "аллея": "алея",
+	"тупик": "тупик", "тупік": "тупик",
+}
+
+// cityMarks precede name of a city, town or village
+var cityMarks = map[string]bool{
+	"м": true, "місто": true, "г": true, "город": true, "гор": true,
+	"смт": true, "пгт": true, "с": true, "село": true, "сел": true,
+	"с-ще": true, "селище": true, "пос": true, "поселок": true, "посёлок": true,
+}
+
+// regionMarks and areaMarks follow names of regions and districts
+var (
+	regionMarks = map[string]bool{"обл": true, "область": true}
+	areaMarks   = map[string]bool{"р-н": true, "район": true, "р": true}
+)
+
+// houseMarks precede house number, partMarks precede building (block) number
+var (
+	houseMarks = map[string]bool{"буд": true, "будинок": true, "б": true, "д": true, "дом": true, "№": true}
+	partMarks  = map[string]bool{"корп": true, "корпус": true, "к": true}
+	skipWords  = map[string]bool{"україна": true, "украина": true, "ukraine": true}
+)
+
+// addrWords maps RU spellings of common city and street names to UA ones
+// (words which differ not only in letters, see phonWord)
+var addrWords = map[string]string{
+	"киев": "київ", "харьков": "харків", "одесса": "одеса", "днепр": "дніпро",
+	"днепропетровск": "дніпро", "львов": "львів", "запорожье": "запоріжжя",
+	"николаев": "миколаїв", "винница": "вінниця", "черкассы": "черкаси",
+	"чернигов": "чернігів", "сумы": "суми", "ровно": "рівне", "луцк": "луцьк",
+	"кропивницкий": "кропивницький", "хмельницкий": "хмельницький",
+	"ивано-франковск": "івано-франківськ", "тернополь": "тернопіль",
+	"черновцы": "чернівці", "кривой": "кривий", "рог": "ріг",
+	"победы": "перемоги", "мира": "миру", "независимости": "незалежності",
+	"леси": "лесі", "украинки": "українки", "школьная": "шкільна",
+	"киевская": "київська", "героев": "героїв", "новая": "нова",
+	"крещатик": "хрещатик", "гагарина": "гагаріна", "садовая": "садова",
+}
+
+// parseAddr extracts region, city, street type and name, house number
+// from free-text address, components which are not found are left empty
+func parseAddr(s string) addrParts {
+	var (
+		a    addrParts
+		t    = tokenizeName(s)
+		cur  []string // words of street name
+		done bool     // house number is found, rest (flat, office) is ignored
+		typ  = -1     // index of street type
+	)
+
+	for i := 0; i < len(t) && !done; i++ {
+		l := strings.ToLower(t[i])
+		next := ""
+		if i+1 < len(t) {
+			next = strings.ToLower(t[i+1])
+		}
+
+		switch {
+		case skipWords[l]:
+		case regionMarks[next]:
+			a.Region = t[i]
+			i++
+		case areaMarks[next] && !isNumber(l):
+			i++
+		case regionMarks[l] || areaMarks[l]:
+		case cityMarks[l] && next != "" && !isNumber(next) && a.City == "":
+			a.City = addrWord(t[i+1])
+			i++
+		case streetTypes[l] != "" && a.Type == "":
+			a.Type = streetTypes[l]
+			typ = i
+			if a.Street == "" && len(cur) > 0 && (isNumber(next) || houseMarks[next]) {
+				a.Street = strings.Join(cur, " ") // "Шевченка вул., 5"
+			}
+			cur = cur[:0]
+		case isNumber(l) && len(l) == 5 && len(cur) == 0 && a.Street == "":
+			// postal code
+		case houseMarks[l] && isNumber(next):
+		case isNumber(l) && typ == i-1 && len(cur) == 0 && isStreetWord(next):
+			cur = append(cur, l) // numbered street: "вул. 8 Березня, 3"
+		case isNumber(l):
+			if a.Street == "" {
+				a.Street = strings.Join(cur, " ")
+			}
+			a.House, i = parseHouse(t, i)
+			done = true
+		case a.City == "" && a.Type == "" && isCity(l):
+			a.City = addrWord(t[i])
+		default:
+			cur = append(cur, addrWord(t[i]))
+		}
+	}
+
+	if a.Street == "" {
+		a.Street = strings.Join(cur, " ")
+	}
+
+	return a
+}
+
+// parseHouse returns canonical house number starting at i ("5", "5 а", "5/7", "5 корп. 2")
+// and index of the last token of the number
+func parseHouse(t []string, i int) (string, int) {
+	h := t[i]
+	for i+1 < len(t) {
+		l := strings.ToLower(t[i+1])
+		switch {
+		case partMarks[l] && i+2 < len(t) && isNumber(t[i+2]):
+			h += "к" + t[i+2]
+			i += 2
+		case utf8.RuneCountInString(l) == 1 && !isNumber(l) && !partMarks[l] && !cityMarks[l]:
+			h += l
+			i++
+		default:
+			return strings.ToLower(h), i
+		}
+	}
+	return strings.ToLower(h), i
+}
+
+// isStreetWord returns true if s may continue street name after number
+// (not a number, house letter or mark)
+func isStreetWord(s string) bool {
+	return s != "" && !isNumber(s) && utf8.RuneCountInString(s) > 1 &&
+		!houseMarks[s] && !partMarks[s] && !cityMarks[s] && streetTypes[s] == ""
+}
+
+func isCity(s string) bool {
+	if _, ok := addrWords[s]; ok {
+		return true
+	}
+	for _, v := range addrWords {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// addrWord returns UA spelling of the word if it is known
+func addrWord(s string) string {
+	if w, ok := addrWords[strings.ToLower(s)]; ok {
+		return w
+	}
+	return s
+}
+
+// canon returns canonical notation of the address or "" if there is no street
+// (house number alone does not identify address)
+func (a addrParts) canon() string {
+	if a.Street == "" {
+		return ""
+	}
+
+	typ := a.Type
+	if typ == "" {
+		typ = streetTypes["вул"]
+	}
+
+	return strings.Join([]string{
+		phonText(a.City),
+		typ,
+		phonText(a.Street),
+		a.House,
+	}, "|")
+}
+
+// phonText returns lower-case words without UA/RU spelling differences
+func phonText(s string) string {
+	t := tokenizeName(s)
+	for i := range t {
+		t[i] = phonWord(addrWord(t[i]))
+	}
+	return strings.Join(t, " ")
+}
+
+// phonWord folds letters which differ in UA/RU spelling (і/и/ы, е/є/э, ь)
+// and Latin lookalikes, and drops inflection vowels at the end of long words:
+// "Шевченка", "Шевченко" -> "шевченк"
+func phonWord(s string) string {
+	r := make([]rune, 0, len(s))
+	for _, c := range strings.ToLower(s) {
+		switch c {
+		case 'і', 'ї', 'ы', 'i':
+			c = 'и'
+		case 'є', 'э', 'ё', 'e':
+			c = 'е'
+		case 'ґ':
+			c = 'г'
+		case 'a':
+			c = 'а'
+		case 'o':
+			c = 'о'
+		case 'c':
+			c = 'с'
+		case 'p':
+			c = 'р'
+		case 'x':
+			c = 'х'
+		case 'ь', 'ъ', '\'', '’', 'ʼ':
+			continue
+		}
+		r = append(r, c)
+	}
+
+	for len(r) > 3 && strings.ContainsRune("аеиоуяюй", r[len(r)-1]) {
+		r = r[:len(r)-1]
+	}
+
+	return string(r)
+}
+
+// makeMagicNorm returns normalized magic string of name, head and address
+// or "" if address cannot be parsed
+func makeMagicNorm(name, head, addr string) (string, addrParts) {
+	a := parseAddr(addr)
+	c := a.canon()
+	if c == "" {
+		return "", a
+	}
+
+	if head != "" {
+		return makeMagicHead(phonText(name), phonText(head), c), a
+	}
+	return makeMagicName(phonText(name), c), a
+}
+
+func keyNadr() string {
+	return makeKey(nsHset, "nadr")
+}
+
+// getLinkNadr returns addr links by normalized keys
+func getLinkNadr(v []string) ([]linkAddr, error) {
+	ids, err := getHashFields(keyNadr(), v)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := getLinkAddrCache(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range out {
+		if ids[i] == "" {
+			out[i] = linkAddr{}
+		}
+	}
+
+	return out, nil
+}
+
+// putNadrAddr remembers addr keys of normalized keys linked by name,
+// normalized keys which are already known are kept
+func putNadrAddr(norm, keys []string) error {
+	if len(norm) == 0 {
+		return nil
+	}
+
+	uniq, idx := uniqKeys(norm)
+	look := make([]string, len(uniq))
+	for i := range norm {
+		if look[idx[i]] == "" {
+			look[idx[i]] = keys[i]
+		}
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	for p := 0; p < len(uniq); p += lookChunk {
+		q := lookEnd(p, len(uniq))
+		for i := p; i < q; i++ {
+			err := c.Send("HSETNX", keyNadr(), uniq[i], look[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := c.Do("")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseAddr returns components of addresses.
+// JSON array: ["м. Київ, вул. Шевченка, 5"]
+func ParseAddr(data []byte) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]addrParts, len(v))
+	for i := range v {
+		out[i] = parseAddr(v[i])
+	}
+
+	return out, nil
+}
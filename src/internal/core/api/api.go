@@ -33,25 +33,77 @@ var (
 		"GET /redis/info": pipe.Use(pipe.Head, pipe.Gzip, pipe.Wrap(core.Info), pipe.Resp, pipe.Tail), // ?
 
 		"POST /system/get-auth": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetAuth), pipe.Resp, pipe.Tail),
-		"POST /system/set-auth": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.SetAuth), pipe.Resp, pipe.Tail),
-		"POST /system/del-auth": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.DelAuth), pipe.Resp, pipe.Tail),
+		"POST /system/set-auth": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetAuth)), pipe.Resp, pipe.Tail),
+		"POST /system/del-auth": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelAuth)), pipe.Resp, pipe.Tail),
 
-		"POST /system/get-addr": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetAddr), pipe.Resp, pipe.Tail),
-		"POST /system/set-addr": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.SetAddr), pipe.Resp, pipe.Tail),
-		"POST /system/del-addr": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.DelAddr), pipe.Resp, pipe.Tail),
+		"POST /system/get-addr":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetAddr), pipe.Resp, pipe.Tail),
+		"POST /system/set-addr":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetAddr)), pipe.Resp, pipe.Tail),
+		"PUT /system/set-addr":   pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetAddr)), pipe.Resp, pipe.Tail),
+		"PATCH /system/set-addr": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.UpdAddr)), pipe.Resp, pipe.Tail),
+		"POST /system/del-addr":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelAddr)), pipe.Resp, pipe.Tail),
 
-		"POST /system/get-drug": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetDrug), pipe.Resp, pipe.Tail),
-		"POST /system/set-drug": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.SetDrug), pipe.Resp, pipe.Tail),
-		"POST /system/del-drug": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.DelDrug), pipe.Resp, pipe.Tail),
+		"POST /system/get-drug":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetDrug), pipe.Resp, pipe.Tail),
+		"POST /system/set-drug":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetDrug)), pipe.Resp, pipe.Tail),
+		"PUT /system/set-drug":   pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetDrug)), pipe.Resp, pipe.Tail),
+		"PATCH /system/set-drug": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.UpdDrug)), pipe.Resp, pipe.Tail),
+		"POST /system/del-drug":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelDrug)), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-egrp": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetEgrp), pipe.Resp, pipe.Tail),
+		"POST /system/reindex":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.Reindex), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-xwlk": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetXwlk), pipe.Resp, pipe.Tail),
+		"POST /system/set-xwlk": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetXwlk)), pipe.Resp, pipe.Tail),
+		"POST /system/del-xwlk": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelXwlk)), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-barc": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetBarc), pipe.Resp, pipe.Tail),
+		"POST /system/set-barc": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetBarc)), pipe.Resp, pipe.Tail),
+		"POST /system/del-barc": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelBarc)), pipe.Resp, pipe.Tail),
+
+		"POST /system/parse-name": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.ParseName), pipe.Resp, pipe.Tail),
+		"POST /system/parse-addr": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.ParseAddr), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-name": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetName), pipe.Resp, pipe.Tail),
+		"POST /system/set-name": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetName)), pipe.Resp, pipe.Tail),
+		"POST /system/del-name": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelName)), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-rich": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetRich), pipe.Resp, pipe.Tail),
+		"POST /system/set-rich": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetRich)), pipe.Resp, pipe.Tail),
+		"POST /system/del-rich": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelRich)), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-effect": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetEffect), pipe.Resp, pipe.Tail),
+		"POST /system/set-effect": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetEffect)), pipe.Resp, pipe.Tail),
+		"POST /system/del-effect": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelEffect)), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-span": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetSpan), pipe.Resp, pipe.Tail),
+		"POST /system/set-span": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetSpan)), pipe.Resp, pipe.Tail),
+		"POST /system/del-span": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelSpan)), pipe.Resp, pipe.Tail),
 
 		"POST /system/get-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetStat), pipe.Resp, pipe.Tail),
-		"POST /system/set-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.SetStat), pipe.Resp, pipe.Tail),
-		"POST /system/del-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.DelStat), pipe.Resp, pipe.Tail),
+		"POST /system/set-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetStat)), pipe.Resp, pipe.Tail),
+		"POST /system/del-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelStat)), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-retn":      pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetRetn), pipe.Resp, pipe.Tail),
+		"POST /system/set-retn":      pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.SetRetn)), pipe.Resp, pipe.Tail),
+		"POST /system/del-retn":      pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.DelRetn)), pipe.Resp, pipe.Tail),
+		"POST /system/get-retn-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetRetnStat), pipe.Resp, pipe.Tail),
+		"POST /system/enforce":       pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.Enforce), pipe.Resp, pipe.Tail),
+
+		"POST /system/get-hist": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetHist), pipe.Resp, pipe.Tail),
+		"POST /system/undo":     pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(audit(core.Undo)), pipe.Resp, pipe.Tail),
+
+		"POST /system/migrate":            pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.Migrate), pipe.Resp, pipe.Tail),
+		"POST /system/check":              pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.Check), pipe.Resp, pipe.Tail),
+		"POST /system/verify":             pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.Verify), pipe.Resp, pipe.Tail),
+		"POST /system/reencrypt":          pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.Reencrypt), pipe.Resp, pipe.Tail),
+		"POST /system/get-reencrypt-stat": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetReencryptStat), pipe.Resp, pipe.Tail),
 
 		// Tracker funcs
 		"POST /system/get-meta": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetMeta), pipe.Resp, pipe.Tail),
 		"POST /system/get-zlog": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetZlog), pipe.Resp, pipe.Tail),
 
+		"POST /system/get-arch":      pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetArch), pipe.Resp, pipe.Tail),
+		"POST /system/get-arch-data": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(getarch), pipe.Resp, pipe.Tail),
+
 		// DEPRECATED Converter from old school style /data/add
 		"POST /data/add": pipe.Use(pipe.Conv, pipe.Head, pipe.Auth(core.Pass), pipe.Meta, pipe.Wrap(putd), pipe.Resp, pipe.Tail),
 		"POST /addr/get": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetAddr2), pipe.Resp, pipe.Tail),
@@ -63,6 +115,10 @@ var (
 
 		"POST /recognize": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Meta, pipe.Wrap(rcgn), pipe.Resp, pipe.Tail),
 
+		"POST /recognize/put-job":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Meta, pipe.Wrap(putj), pipe.Resp, pipe.Tail),
+		"POST /recognize/get-job":  pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(core.GetJob), pipe.Resp, pipe.Tail),
+		"POST /recognize/get-data": pipe.Use(pipe.Head, pipe.Auth(core.Pass), pipe.Gzip, pipe.Wrap(getj), pipe.Resp, pipe.Tail),
+
 		// => Debug mode only, when pref.Debug == true
 		"GET /debug/vars":               pipe.Use(pipe.Head, pipe.Gzip, pipe.StdH, pipe.Resp, pipe.Tail), // expvar
 		"GET /debug/pprof/":             pipe.Use(pipe.Head, pipe.Gzip, pipe.StdH, pipe.Resp, pipe.Tail), // net/http/pprof
@@ -111,6 +167,13 @@ func MakeRouter() http.Handler {
 	return r
 }
 
+// audit passes API key and request UUID to dictionary writers
+func audit(f func([]byte, string, string) (interface{}, error)) func([]byte, http.Header, http.Header) (interface{}, error) {
+	return func(data []byte, r, _ http.Header) (interface{}, error) {
+		return f(data, r.Get(pipe.HeaderAuth), r.Get(pipe.HeaderUUID))
+	}
+}
+
 func putd(data []byte, r, _ http.Header) (interface{}, error) {
 	return core.Putd([]byte(r.Get("Content-Meta")), data)
 }
@@ -119,25 +182,60 @@ func rcgn(data []byte, r, _ http.Header) (interface{}, error) {
 	return core.Rcgn([]byte(r.Get("Content-Meta")), data)
 }
 
-func popd(data []byte, _, w http.Header) (interface{}, error) {
-	m, d, err := core.Getd(data, false)
+func putj(data []byte, r, _ http.Header) (interface{}, error) {
+	return core.PutJob([]byte(r.Get("Content-Meta")), data)
+}
+
+func getj(data []byte, _, w http.Header) (interface{}, error) {
+	t, d, err := core.GetJobData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(t, "text/") {
+		w.Set("Content-Type", t) // for writeResp
+	} else {
+		w.Set("Content-Type", "gzip") // raw json for writeResp
+	}
+	return d, nil
+}
+
+func popd(data []byte, r, w http.Header) (interface{}, error) {
+	enc := pipe.Encoding(r)
+	m, d, mf, err := core.Getd(data, false, r.Get(pipe.HeaderAuth), enc)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Set("Content-Encoding", enc)
+	w.Set("Content-Type", "gzip") // for writeResp
+	w.Set("Content-Meta", base64.StdEncoding.EncodeToString(m))
+	w.Set("Content-Manifest", base64.StdEncoding.EncodeToString(mf))
+	return d, nil
+}
+
+func getd(data []byte, r, w http.Header) (interface{}, error) {
+	enc := pipe.Encoding(r)
+	m, d, mf, err := core.Getd(data, true, r.Get(pipe.HeaderAuth), enc)
 	if err != nil {
 		return nil, err
 	}
 
-	w.Set("Content-Encoding", "gzip")
+	w.Set("Content-Encoding", enc)
 	w.Set("Content-Type", "gzip") // for writeResp
 	w.Set("Content-Meta", base64.StdEncoding.EncodeToString(m))
+	w.Set("Content-Manifest", base64.StdEncoding.EncodeToString(mf))
 	return d, nil
 }
 
-func getd(data []byte, _, w http.Header) (interface{}, error) {
-	m, d, err := core.Getd(data, true)
+func getarch(data []byte, r, w http.Header) (interface{}, error) {
+	enc := pipe.Encoding(r)
+	m, d, err := core.GetArchData(data, enc)
 	if err != nil {
 		return nil, err
 	}
 
-	w.Set("Content-Encoding", "gzip")
+	w.Set("Content-Encoding", enc)
 	w.Set("Content-Type", "gzip") // for writeResp
 	w.Set("Content-Meta", base64.StdEncoding.EncodeToString(m))
 	return d, nil
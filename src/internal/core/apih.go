@@ -17,28 +17,33 @@ import (
 )
 
 const (
-	keyAuth  = "list:auth" // FIXME: hset:auth
-	keyStat  = "list:stat" // FIXME: hset:stat
-	keyZlog  = "zset:meta"
 	statusOK = http.StatusOK
+
+	// lookChunk is max number of commands in one pipeline of lookups
+	lookChunk = 1000
 )
 
 var (
-	fldsAddr = []interface{}{"l", "a", "o", "s", "e"}
-	fldsDrug = []interface{}{"l", "d", "b", "c", "s"}
+	fldsAddr = []interface{}{"l", "a", "o", "s", "e", "v"}
+	fldsDrug = []interface{}{"l", "d", "b", "c", "s", "v"}
 )
 
-func Pass(key string) bool {
+// Pass returns false if key is unknown or denied by its status
+// (errors are returned, so requests are not passed when store fails)
+func Pass(key string) (bool, error) {
 	if strings.EqualFold(pref.MasterKey, key) {
-		return true
+		return true, nil
 	}
 
 	c := redis.Conn()
 	defer redis.Free(c)
 
-	v, _ := redis.Bool(c.Do("HEXISTS", keyAuth, key))
+	v, err := redis.Bool(c.Do("HEXISTS", keyAuth(), key))
+	if err != nil || !v {
+		return false, err
+	}
 
-	return v
+	return passStat(c, key)
 }
 
 func GetAuth(data []byte) (interface{}, error) {
@@ -57,7 +62,11 @@ func getLinkAuth(v []string) ([]linkAuth, error) {
 
 	var err error
 	for i := range v {
-		err = c.Send("HGET", keyAuth, v[i])
+		err = c.Send("HGET", keyAuth(), v[i])
+		if err != nil {
+			return nil, err
+		}
+		err = c.Send("HGET", keyAuthStat(), v[i])
 		if err != nil {
 			return nil, err
 		}
@@ -77,59 +86,99 @@ func getLinkAuth(v []string) ([]linkAuth, error) {
 			return nil, err
 		}
 		out[i].Name = r
+		out[i].IDStat, err = redis.Int64(c.Receive())
+		if err != nil && redis.NotErrNil(err) {
+			return nil, err
+		}
 	}
 
 	return out, nil
 }
 
-func SetAuth(data []byte) (interface{}, error) {
-	var v []linkAuth
+// itemAuth is entry of SetAuth: status is changed only if id_stat is set,
+// "id_stat":0 clears it
+type itemAuth struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	IDStat *int64 `json:"id_stat"`
+}
+
+// SetAuth replaces names of API keys, status is kept if id_stat is omitted.
+// JSON array: [{"id":"key1","name":"name1","id_stat":0}]
+func SetAuth(data []byte, auth, uuid string) (interface{}, error) {
+	var v []itemAuth
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return setLinkAuth(v)
+	return setLinkAuth(v, actor{auth, uuid})
 }
 
-func setLinkAuth(v []linkAuth) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	var err error
+func setLinkAuth(v []itemAuth, a actor) (interface{}, error) {
+	keys := make([]string, len(v))
+	vals := make([]map[string]string, len(v))
+	var stat, none []string
+	var svls []map[string]string
 	for i := range v {
-		err = c.Send("HSET", keyAuth, v[i].ID, v[i].Name)
+		keys[i] = v[i].ID
+		vals[i] = nameHash(v[i].Name)
+		switch {
+		case v[i].IDStat == nil:
+			continue
+		case *v[i].IDStat == 0:
+			none = append(none, v[i].ID)
+			continue
+		}
+		stat = append(stat, v[i].ID)
+		svls = append(svls, nameHash(strconv.FormatInt(*v[i].IDStat, 10)))
+	}
+
+	w := &dictWrite{dict: dictAuth, keys: keys, vals: vals}
+	err := testNames(w)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeDict(w, a)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stat) != 0 {
+		err = writeDict(&dictWrite{dict: dictAuthStat, keys: stat, vals: svls}, a)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return statusOK, c.Flush()
+	if len(none) != 0 {
+		err = writeDict(&dictWrite{dict: dictAuthStat, keys: none}, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return statusOK, nil
 }
 
-func DelAuth(data []byte) (interface{}, error) {
+func DelAuth(data []byte, auth, uuid string) (interface{}, error) {
 	var v []string
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return delLinkAuth(v)
+	return delLinkAuth(v, actor{auth, uuid})
 }
 
-func delLinkAuth(v []string) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	var err error
-	for i := range v {
-		err = c.Send("HDEL", keyAuth, v[i])
-		if err != nil {
-			return nil, err
-		}
+func delLinkAuth(v []string, a actor) (interface{}, error) {
+	err := writeDict(&dictWrite{dict: dictAuth, keys: v}, a)
+	if err != nil {
+		return nil, err
 	}
 
-	return statusOK, c.Flush()
+	return statusOK, writeDict(&dictWrite{dict: dictAuthStat, keys: v}, a)
 }
 
 func GetAddr(data []byte) (interface{}, error) {
@@ -147,118 +196,102 @@ func getLinkAddr(v []string) ([]linkAddr, error) {
 	defer redis.Free(c)
 
 	vls := make([]interface{}, 0, len(fldsAddr)+1)
-	var err error
-	for i := range v {
-		vls = append(vls, v[i]) // key
-		vls = append(vls, fldsAddr...)
+	out := make([]linkAddr, len(v))
+	var (
+		r   []interface{}
+		err error
+	)
+	for p := 0; p < len(v); p += lookChunk {
+		q := lookEnd(p, len(v))
+		for i := p; i < q; i++ {
+			vls = append(vls, keyAddr(v[i])) // key
+			vls = append(vls, fldsAddr...)
+
+			err = c.Send("HMGET", vls...)
+			if err != nil {
+				return nil, err
+			}
 
-		err = c.Send("HMGET", vls...)
+			vls = vls[:0]
+		}
+
+		err = c.Flush()
 		if err != nil {
 			return nil, err
 		}
 
-		vls = vls[:0]
+		for i := p; i < q; i++ {
+			out[i].ID = v[i] // key
+			r, err = redis.Intfs(c.Receive())
+			if err != nil && redis.NotErrNil(err) {
+				return nil, err
+			}
+			if len(r) != len(fldsAddr) {
+				continue
+			}
+			out[i].IDLink, _ = redis.Int64(r[0], nil)  // fld "l"
+			out[i].IDAddr, _ = redis.Int64(r[1], nil)  // fld "a"
+			out[i].IDOrgn, _ = redis.Int64(r[2], nil)  // fld "o"
+			out[i].IDStat, _ = redis.Int64(r[3], nil)  // fld "s"
+			out[i].EGRPOU, _ = redis.String(r[4], nil) // fld "e"
+			out[i].Vers, _ = redis.Int64(r[5], nil)    // fld "v"
+		}
 	}
 
-	err = c.Flush()
+	return out, nil
+}
+
+// SetAddr replaces entries (PUT), "vers" is optional expected version.
+func SetAddr(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkAddr
+	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]linkAddr, len(v))
-	var r []interface{}
-	for i := range v {
-		out[i].ID = v[i] // key
-		r, err = redis.Intfs(c.Receive())
-		if err != nil && redis.NotErrNil(err) {
-			return nil, err
-		}
-		if len(r) != len(fldsAddr) {
-			continue
-		}
-		out[i].IDLink, _ = redis.Int64(r[0], nil)  // fld "l"
-		out[i].IDAddr, _ = redis.Int64(r[1], nil)  // fld "a"
-		out[i].IDOrgn, _ = redis.Int64(r[2], nil)  // fld "o"
-		out[i].IDStat, _ = redis.Int64(r[3], nil)  // fld "s"
-		out[i].EGRPOU, _ = redis.String(r[4], nil) // fld "e"
-	}
-
-	return out, nil
+	return setLinkAddr(v, false, actor{auth, uuid})
 }
 
-func SetAddr(data []byte) (interface{}, error) {
+// UpdAddr merges entries into existing ones (PATCH, missing keys fail), "vers" is optional expected version.
+func UpdAddr(data []byte, auth, uuid string) (interface{}, error) {
 	var v []linkAddr
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return setLinkAddr(v)
+	return setLinkAddr(v, true, actor{auth, uuid})
 }
 
-func setLinkAddr(v []linkAddr) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	vls := make([]interface{}, 0, len(fldsAddr)*2+1)
-	var err error
+func setLinkAddr(v []linkAddr, merge bool, a actor) (interface{}, error) {
+	w := &dictWrite{
+		dict:  dictAddr,
+		keys:  make([]string, len(v)),
+		vals:  make([]map[string]string, len(v)),
+		vers:  make([]int64, len(v)),
+		merge: merge,
+	}
 	for i := range v {
-		vls = append(vls, v[i].ID) // key
-		if v[i].IDLink != 0 {
-			vls = append(vls, fldsAddr[0], v[i].IDLink) // fld "l"
-		}
-		if v[i].IDAddr != 0 {
-			vls = append(vls, fldsAddr[1], v[i].IDAddr) // fld "a"
-		}
-		if v[i].IDOrgn != 0 {
-			vls = append(vls, fldsAddr[2], v[i].IDOrgn) // fld "o"
-		}
-		if v[i].IDStat != 0 {
-			vls = append(vls, fldsAddr[3], v[i].IDStat) // fld "s"
-		}
-		if v[i].EGRPOU != "" {
-			vls = append(vls, fldsAddr[4], v[i].EGRPOU) // fld "e"
-		}
-
-		err = c.Send("DEL", v[i].ID)
-		if err != nil {
-			return nil, err
-		}
-
-		err = c.Send("HMSET", vls...)
-		if err != nil {
-			return nil, err
-		}
-
-		vls = vls[:0]
+		w.keys[i] = v[i].ID
+		w.vals[i] = v[i].hash()
+		w.vers[i] = v[i].Vers
 	}
 
-	return statusOK, c.Flush()
+	return statusOK, writeDict(w, a)
 }
 
-func DelAddr(data []byte) (interface{}, error) {
+func DelAddr(data []byte, auth, uuid string) (interface{}, error) {
 	var v []string
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return delLinkAddr(v)
+	return delLinkAddr(v, actor{auth, uuid})
 }
 
-func delLinkAddr(v []string) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	var err error
-	for i := range v {
-		err = c.Send("DEL", v[i])
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return statusOK, c.Flush()
+func delLinkAddr(v []string, a actor) (interface{}, error) {
+	return statusOK, writeDict(&dictWrite{dict: dictAddr, keys: v}, a)
 }
 
 func GetDrug(data []byte) (interface{}, error) {
@@ -272,123 +305,163 @@ func GetDrug(data []byte) (interface{}, error) {
 }
 
 func getLinkDrug(v []string) ([]linkDrug, error) {
+	return getLinkDrugBy(keyDrug, v)
+}
+
+func getLinkDrugBy(key func(string) string, v []string) ([]linkDrug, error) {
 	c := redis.Conn()
 	defer redis.Free(c)
 
 	vls := make([]interface{}, 0, len(fldsDrug)+1)
-	var err error
-	for i := range v {
-		vls = append(vls, v[i]) // key
-		vls = append(vls, fldsDrug...)
+	out := make([]linkDrug, len(v))
+	var (
+		r   []interface{}
+		err error
+	)
+	for p := 0; p < len(v); p += lookChunk {
+		q := lookEnd(p, len(v))
+		for i := p; i < q; i++ {
+			vls = append(vls, key(v[i])) // key
+			vls = append(vls, fldsDrug...)
+
+			err = c.Send("HMGET", vls...)
+			if err != nil {
+				return nil, err
+			}
 
-		err = c.Send("HMGET", vls...)
-		if err != nil {
-			return nil, err
+			vls = vls[:0]
 		}
 
-		vls = vls[:0]
-	}
-
-	err = c.Flush()
-	if err != nil {
-		return nil, err
-	}
-
-	out := make([]linkDrug, len(v))
-	var r []interface{}
-	for i := range v {
-		out[i].ID = v[i] // key
-		r, err = redis.Intfs(c.Receive())
-		if err != nil && redis.NotErrNil(err) {
+		err = c.Flush()
+		if err != nil {
 			return nil, err
 		}
-		if len(r) != len(fldsDrug) {
-			continue
+
+		for i := p; i < q; i++ {
+			out[i].ID = v[i] // key
+			r, err = redis.Intfs(c.Receive())
+			if err != nil && redis.NotErrNil(err) {
+				return nil, err
+			}
+			if len(r) != len(fldsDrug) {
+				continue
+			}
+			out[i].IDLink, _ = redis.Int64(r[0], nil) // fld "l"
+			out[i].IDDrug, _ = redis.Int64(r[1], nil) // fld "d"
+			out[i].IDBrnd, _ = redis.Int64(r[2], nil) // fld "b"
+			out[i].IDCatg, _ = redis.Int64(r[3], nil) // fld "c"
+			out[i].IDStat, _ = redis.Int64(r[4], nil) // fld "s"
+			out[i].Vers, _ = redis.Int64(r[5], nil)   // fld "v"
 		}
-		out[i].IDLink, _ = redis.Int64(r[0], nil) // fld "l"
-		out[i].IDDrug, _ = redis.Int64(r[1], nil) // fld "d"
-		out[i].IDBrnd, _ = redis.Int64(r[2], nil) // fld "b"
-		out[i].IDCatg, _ = redis.Int64(r[3], nil) // fld "c"
-		out[i].IDStat, _ = redis.Int64(r[4], nil) // fld "s"
 	}
 
 	return out, nil
-
 }
 
-func SetDrug(data []byte) (interface{}, error) {
-	var v []linkDrug
-	err := json.Unmarshal(data, &v)
-	if err != nil {
-		return nil, err
+// lookEnd returns end of chunk of n lookups which starts at p
+func lookEnd(p, n int) int {
+	if p+lookChunk < n {
+		return p + lookChunk
 	}
-
-	return setLinkDrug(v)
+	return n
 }
 
-func setLinkDrug(v []linkDrug) (interface{}, error) {
+// getHashFields returns values of fields of hash ("" if missing), fields are
+// looked up by chunks of lookChunk
+func getHashFields(key string, flds []string) ([]string, error) {
 	c := redis.Conn()
 	defer redis.Free(c)
 
-	vls := make([]interface{}, 0, len(fldsDrug)*2+1)
-	var err error
-	for i := range v {
-		vls = append(vls, v[i].ID) // key
-		if v[i].IDLink != 0 {
-			vls = append(vls, fldsDrug[0], v[i].IDLink) // fld "l"
-		}
-		if v[i].IDDrug != 0 {
-			vls = append(vls, fldsDrug[1], v[i].IDDrug) // fld "d"
-		}
-		if v[i].IDBrnd != 0 {
-			vls = append(vls, fldsDrug[2], v[i].IDBrnd) // fld "b"
-		}
-		if v[i].IDCatg != 0 {
-			vls = append(vls, fldsDrug[3], v[i].IDCatg) // fld "c"
-		}
-		if v[i].IDStat != 0 {
-			vls = append(vls, fldsDrug[4], v[i].IDStat) // fld "s"
+	out := make([]string, len(flds))
+	vls := make([]interface{}, 0, lookChunk+1)
+	for p := 0; p < len(flds); p += lookChunk {
+		q := lookEnd(p, len(flds))
+
+		vls = append(vls[:0], key)
+		for i := p; i < q; i++ {
+			vls = append(vls, flds[i])
 		}
 
-		err = c.Send("DEL", v[i].ID)
+		r, err := redis.Strings(c.Do("HMGET", vls...))
 		if err != nil {
 			return nil, err
 		}
+		copy(out[p:q], r)
+	}
 
-		err = c.Send("HMSET", vls...)
-		if err != nil {
-			return nil, err
+	return out, nil
+}
+
+// uniqKeys returns unique keys and index of unique key for each key
+func uniqKeys(v []string) ([]string, []int) {
+	var (
+		uniq = make([]string, 0, len(v))
+		idx  = make([]int, len(v))
+		pos  = make(map[string]int, len(v))
+	)
+	for i := range v {
+		j, ok := pos[v[i]]
+		if !ok {
+			j = len(uniq)
+			pos[v[i]] = j
+			uniq = append(uniq, v[i])
 		}
+		idx[i] = j
+	}
+	return uniq, idx
+}
 
-		vls = vls[:0]
+// SetDrug replaces entries (PUT), "vers" is optional expected version.
+func SetDrug(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkDrug
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
 	}
 
-	return statusOK, c.Flush()
+	return setLinkDrug(v, false, actor{auth, uuid})
 }
 
-func DelDrug(data []byte) (interface{}, error) {
-	var v []string
+// UpdDrug merges entries into existing ones (PATCH, missing keys fail), "vers" is optional expected version.
+func UpdDrug(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkDrug
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return delLinkDrug(v)
+	return setLinkDrug(v, true, actor{auth, uuid})
 }
 
-func delLinkDrug(v []string) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	var err error
+func setLinkDrug(v []linkDrug, merge bool, a actor) (interface{}, error) {
+	w := &dictWrite{
+		dict:  dictDrug,
+		keys:  make([]string, len(v)),
+		vals:  make([]map[string]string, len(v)),
+		vers:  make([]int64, len(v)),
+		merge: merge,
+	}
 	for i := range v {
-		err = c.Send("DEL", v[i])
-		if err != nil {
-			return nil, err
-		}
+		w.keys[i] = v[i].ID
+		w.vals[i] = v[i].hash()
+		w.vers[i] = v[i].Vers
 	}
 
-	return statusOK, c.Flush()
+	return statusOK, writeDict(w, a)
+}
+
+func DelDrug(data []byte, auth, uuid string) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return delLinkDrug(v, actor{auth, uuid})
+}
+
+func delLinkDrug(v []string, a actor) (interface{}, error) {
+	return statusOK, writeDict(&dictWrite{dict: dictDrug, keys: v}, a)
 }
 
 func GetStat(data []byte) (interface{}, error) {
@@ -407,7 +480,7 @@ func getLinkStat(v []int64) ([]linkStat, error) {
 
 	var err error
 	for i := range v {
-		err = c.Send("HGET", keyStat, v[i])
+		err = c.Send("HGET", keyStat(), v[i])
 		if err != nil {
 			return nil, err
 		}
@@ -432,54 +505,50 @@ func getLinkStat(v []int64) ([]linkStat, error) {
 	return out, nil
 }
 
-func SetStat(data []byte) (interface{}, error) {
+func SetStat(data []byte, auth, uuid string) (interface{}, error) {
 	var v []linkStat
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return setLinkStat(v)
+	return setLinkStat(v, actor{auth, uuid})
 }
 
-func setLinkStat(v []linkStat) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	var err error
+func setLinkStat(v []linkStat, a actor) (interface{}, error) {
+	keys := make([]string, len(v))
+	vals := make([]map[string]string, len(v))
 	for i := range v {
-		err = c.Send("HSET", keyStat, v[i].ID, v[i].Name)
-		if err != nil {
-			return nil, err
-		}
+		keys[i] = strconv.FormatInt(v[i].ID, 10)
+		vals[i] = nameHash(v[i].Name)
+	}
+
+	w := &dictWrite{dict: dictStat, keys: keys, vals: vals}
+	err := testNames(w)
+	if err != nil {
+		return nil, err
 	}
 
-	return statusOK, c.Flush()
+	return statusOK, writeDict(w, a)
 }
 
-func DelStat(data []byte) (interface{}, error) {
+func DelStat(data []byte, auth, uuid string) (interface{}, error) {
 	var v []int64
 	err := json.Unmarshal(data, &v)
 	if err != nil {
 		return nil, err
 	}
 
-	return delLinkStat(v)
+	return delLinkStat(v, actor{auth, uuid})
 }
 
-func delLinkStat(v []int64) (interface{}, error) {
-	c := redis.Conn()
-	defer redis.Free(c)
-
-	var err error
+func delLinkStat(v []int64, a actor) (interface{}, error) {
+	keys := make([]string, len(v))
 	for i := range v {
-		err = c.Send("HDEL", keyStat, v[i])
-		if err != nil {
-			return nil, err
-		}
+		keys[i] = strconv.FormatInt(v[i], 10)
 	}
 
-	return statusOK, c.Flush()
+	return statusOK, writeDict(&dictWrite{dict: dictStat, keys: keys}, a)
 }
 
 func setZlog(m *meta) error {
@@ -491,12 +560,12 @@ func setZlog(m *meta) error {
 		return err
 	}
 
-	err = c.Send("ZADD", keyZlog, m.Unix, m.UUID)
+	err = c.Send("ZADD", keyZlog(), m.Unix, m.UUID)
 	if err != nil {
 		return err
 	}
 
-	err = c.Send("SET", m.UUID, z, "EX", 60*60*24*3)
+	err = c.Send("SET", keyMeta(m.UUID), z, "EX", 60*60*24*3)
 	if err != nil {
 		return err
 	}
@@ -508,13 +577,13 @@ func GetZlog(data []byte) (interface{}, error) {
 	c := redis.Conn()
 	defer redis.Free(c)
 
-	res, err := redis.Strings(c.Do("ZRANGEBYSCORE", keyZlog, "-inf", "+inf"))
+	res, err := redis.Strings(c.Do("ZRANGEBYSCORE", keyZlog(), "-inf", "+inf"))
 	if err != nil {
 		return nil, err
 	}
 
 	for i := range res {
-		err = c.Send("GET", res[i])
+		err = c.Send("GET", keyMeta(res[i]))
 		if err != nil {
 			return nil, err
 		}
@@ -557,7 +626,7 @@ func remZlog(u int64) error {
 	c := redis.Conn()
 	defer redis.Free(c)
 
-	_, err := redis.Int64(c.Do("ZREMRANGEBYSCORE", keyZlog, "-inf", u))
+	_, err := redis.Int64(c.Do("ZREMRANGEBYSCORE", keyZlog(), "-inf", u))
 	return err
 }
 
@@ -571,7 +640,7 @@ func GetMeta(data []byte) (interface{}, error) {
 	c := redis.Conn()
 	defer redis.Free(c)
 
-	z, err := redis.Bytes(c.Do("GET", v))
+	z, err := redis.Bytes(c.Do("GET", keyMeta(v)))
 	if err != nil /*&& err != redis.ErrNil*/ {
 		return nil, err
 	}
@@ -676,45 +745,92 @@ func Putd(meta, data []byte) (interface{}, error) {
 		return nil, err
 	}
 
-	go func() { // ?
-		p, err := packMetaData(meta, data)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	p, err := packMetaData(meta, data)
+	if err != nil {
+		return nil, err
+	}
 
-		o := makeFileName(m.Auth.ID, m.UUID, normHTag(m.HTag))
-		err = minio.Put(bucketStreamIn, o, p)
-		if err != nil {
-			log.Println(err)
-		}
-	}()
+	// package is streamed to archive and copied to stream-in, so upload
+	// is not accepted unless it is archived
+	a, err := putArch(m, p)
+	if err != nil {
+		return nil, err
+	}
+
+	o := makeFileName(m.Auth.ID, m.UUID, normHTag(m.HTag), m.Unix)
+	err = minio.Copy(bucketStreamIn, o, bucketArchive, a)
+	if err != nil {
+		return nil, err
+	}
 
 	return nil /*m.UUID*/, nil
 }
 
-func Getd(data []byte, keep bool) ([]byte, []byte, error) {
+// Getd returns meta, data compressed by enc (gzip or zstd) and manifest of
+// object, names are added to links by enrichment rules of consumer (auth ID)
+// or route (bucket).
+// Object is deleted (after enrichment) unless keep is set or package is
+// corrupted or enrichment fails.
+func Getd(data []byte, keep bool, auth, enc string) ([]byte, []byte, []byte, error) {
 	p, err := decodePath(data)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	f, err := minio.Get(p.Bucket, p.Object)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	defer minio.Free(f)
-	defer func() {
-		if keep {
-			return
-		}
+
+	m, d, k, err := unpackMetaDataPack(f, enc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	d, err = richData(auth, p.Bucket, m, d, enc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	mf, err := json.Marshal(k.manifest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !keep {
 		err = minio.Del(p.Bucket, p.Object)
 		if err != nil {
 			log.Println(err)
 		}
-	}()
+	}
+
+	return m, d, mf, nil
+}
+
+// Verify reads package of object and returns its manifest and mismatches.
+// JSON object: {"bucket":"stream-out","object":"..."}
+func Verify(data []byte) (interface{}, error) {
+	p, err := decodePath(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := minio.Get(p.Bucket, p.Object)
+	if err != nil {
+		return nil, err
+	}
+	defer minio.Free(f)
+
+	k, err := readPack(f)
+	if err != nil {
+		return nil, err
+	}
 
-	return unpackMetaData(f, false, true)
+	return struct {
+		packManifest
+		Fail []string `json:"fail,omitempty"`
+	}{k.manifest, k.verify()}, nil
 }
 
 func Deld(data []byte) (interface{}, error) {
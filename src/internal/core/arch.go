@@ -0,0 +1,300 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"internal/core/pref"
+	"internal/database/minio"
+	"internal/database/redis"
+)
+
+// Every accepted upload (tar of stream-in as it was sent) is kept in bucket
+// archive under yyyy/mm/dd/<auth>/<htag>/<uuid>.tar (date of upload, UTC,
+// auth is hex SHA-256 of API key, see authPart).
+// Redis scheme:
+// HASH => key="<prefix>:hset:arch"
+// HSET key uuid->object
+// Days older than pref.ArchiveDays are removed by trimArch.
+const (
+	bucketArchive = "archive"
+
+	archDay   = "2006/01/02"
+	archScan  = 1000
+	archTick  = time.Hour
+	archRange = 31 // max days of one list request
+)
+
+type itemArch struct {
+	Object string `json:"object,omitempty"`
+	Date   string `json:"date,omitempty"`
+	Auth   string `json:"auth,omitempty"` // hex SHA-256 of API key
+	HTag   string `json:"htag,omitempty"`
+	UUID   string `json:"uuid,omitempty"`
+}
+
+func keyArch() string {
+	return makeKey(nsHset, "arch")
+}
+
+func archName(m *meta) string {
+	t := time.Now()
+	if m.Unix != 0 {
+		t = time.Unix(m.Unix, 0)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s.tar",
+		t.UTC().Format(archDay), authPart(m.Auth.ID), namePart(normHTag(m.HTag)), namePart(m.UUID))
+}
+
+func splitArchName(o string) itemArch {
+	v := itemArch{Object: o}
+	s := strings.Split(o, "/")
+	if len(s) != 6 {
+		return v
+	}
+	v.Date = strings.Join(s[:3], "-")
+	v.Auth = s[3]
+	v.HTag = s[4]
+	v.UUID = strings.TrimSuffix(s[5], ".tar")
+	return v
+}
+
+// putArch stores original tar of upload and returns its object name
+func putArch(m *meta, r io.Reader) (string, error) {
+	o := archName(m)
+	err := minio.Put(bucketArchive, o, r)
+	if err != nil {
+		return "", err
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	_, err = c.Do("HSET", keyArch(), m.UUID, o)
+	if err != nil {
+		return "", err
+	}
+
+	return o, nil
+}
+
+func findArch(uuid string) (string, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	o, err := redis.String(c.Do("HGET", keyArch(), uuid))
+	if err != nil && redis.NotErrNil(err) {
+		return "", err
+	}
+	if o == "" {
+		return "", fmt.Errorf("core: archive of %s not found", uuid)
+	}
+	return o, nil
+}
+
+// GetArch lists archived uploads by UUID or by source (auth) and date range.
+// JSON object: {"uuid":"..."} or {"auth":"...","from":"2006-01-02","to":"2006-01-02","limit":1000}
+func GetArch(data []byte) (interface{}, error) {
+	v := struct {
+		UUID  string `json:"uuid,omitempty"`
+		Auth  string `json:"auth,omitempty"`
+		From  string `json:"from,omitempty"`
+		To    string `json:"to,omitempty"`
+		Limit int    `json:"limit,omitempty"`
+	}{}
+
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.UUID != "" {
+		o, err := findArch(v.UUID)
+		if err != nil {
+			return nil, err
+		}
+		return []itemArch{splitArchName(o)}, nil
+	}
+
+	from, to, err := archDates(v.From, v.To)
+	if err != nil {
+		return nil, err
+	}
+	if v.Limit <= 0 || v.Limit > archScan {
+		v.Limit = archScan
+	}
+
+	out := []itemArch{}
+	for t := from; !t.After(to) && len(out) < v.Limit; t = t.AddDate(0, 0, 1) {
+		p := t.Format(archDay) + "/"
+		if v.Auth != "" {
+			p += authPart(v.Auth) + "/"
+		}
+		l, err := minio.Scan(bucketArchive, p, true, v.Limit-len(out))
+		if err != nil {
+			return nil, err
+		}
+		for i := range l {
+			out = append(out, splitArchName(l[i]))
+		}
+	}
+
+	return out, nil
+}
+
+// archDates parses date range (today if empty)
+func archDates(from, to string) (time.Time, time.Time, error) {
+	t := time.Now().UTC().Truncate(24 * time.Hour)
+	f := t
+
+	var err error
+	if to != "" {
+		t, err = time.Parse("2006-01-02", to)
+		if err != nil {
+			return t, t, err
+		}
+		f = t
+	}
+	if from != "" {
+		f, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			return f, t, err
+		}
+	}
+
+	if f.After(t) || t.Sub(f) >= archRange*24*time.Hour {
+		return f, t, fmt.Errorf("core: invalid date range %s - %s (max %d days)", from, to, archRange)
+	}
+
+	return f, t, nil
+}
+
+// GetArchData returns original meta and data of archived upload compressed
+// by enc (gzip or zstd).
+// JSON object: {"uuid":"..."} or {"object":"..."}
+func GetArchData(data []byte, enc string) ([]byte, []byte, error) {
+	v := itemArch{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if v.Object == "" {
+		v.Object, err = findArch(v.UUID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := minio.Get(bucketArchive, v.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer minio.Free(f)
+
+	return unpackMetaData(f, enc)
+}
+
+func trimArch(d time.Duration) {
+	_ = time.AfterFunc(d, func() {
+		if pref.ArchiveDays > 0 {
+			n, err := remArch(time.Now().UTC().AddDate(0, 0, -pref.ArchiveDays))
+			if err != nil {
+				log.Println(err)
+			}
+			if n != 0 {
+				log.Println("archive: removed", n)
+			}
+		}
+		trimArch(d)
+	})
+}
+
+// remArch removes archived uploads of days before t
+func remArch(t time.Time) (int, error) {
+	last := t.Format(archDay) + "/"
+
+	var days []string
+	err := walkArchDays(func(p string) bool {
+		if p >= last {
+			return false
+		}
+		days = append(days, p)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := range days {
+		for {
+			l, err := minio.Scan(bucketArchive, days[i], true, archScan)
+			if err != nil {
+				return n, err
+			}
+			if len(l) == 0 {
+				break
+			}
+
+			uuid := make([]interface{}, 0, len(l)+1)
+			uuid = append(uuid, keyArch())
+			for j := range l {
+				err = minio.Del(bucketArchive, l[j])
+				if err != nil {
+					return n, err
+				}
+				uuid = append(uuid, splitArchName(l[j]).UUID)
+				n++
+			}
+
+			err = delArchKeys(uuid)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// walkArchDays calls f with day prefixes (yyyy/mm/dd/) in lexical order while f returns true
+func walkArchDays(f func(string) bool) error {
+	var walk func(p string, depth int) (bool, error)
+	walk = func(p string, depth int) (bool, error) {
+		l, err := minio.Scan(bucketArchive, p, false, archScan)
+		if err != nil {
+			return false, err
+		}
+		for i := range l {
+			if !strings.HasSuffix(l[i], "/") {
+				continue
+			}
+			ok := true
+			if depth == 2 {
+				ok = f(l[i])
+			} else {
+				ok, err = walk(l[i], depth+1)
+			}
+			if !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	_, err := walk("", 0)
+	return err
+}
+
+func delArchKeys(v []interface{}) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	_, err := c.Do("HDEL", v...)
+	return err
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// LIST => key="<prefix>:hist:<dict>:<key>" (newest first, trimmed to histN)
+// LIST => key="<prefix>:bulk:<uuid>" (in order of writes, expires after bulkTTL)
+// JSON: {"dict":"drug","key":"key1","old":{"l":"1"},"new":{"l":"2"},"auth":"...","uuid":"...","time":"...","unix":1}
+const (
+	dictAuth = "auth"
+	dictAddr = "addr"
+	dictDrug = "drug"
+	dictStat = "stat"
+
+	nsHist = "hist"
+	nsBulk = "bulk"
+
+	histN   = 1000
+	bulkTTL = 60 * 60 * 24 * 90
+)
+
+// actor is who makes changes: API key and request UUID
+type actor struct {
+	auth string
+	uuid string
+}
+
+type auditItem struct {
+	Dict string            `json:"dict"`
+	Key  string            `json:"key"`
+	Old  map[string]string `json:"old,omitempty"`
+	New  map[string]string `json:"new,omitempty"`
+	Auth string            `json:"auth,omitempty"`
+	UUID string            `json:"uuid,omitempty"`
+	Time string            `json:"time,omitempty"`
+	Unix int64             `json:"unix,omitempty"`
+}
+
+type auditQuery struct {
+	Dict string `json:"dict,omitempty"`
+	Key  string `json:"key,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+	Unix int64  `json:"unix,omitempty"`
+}
+
+func keyHist(dict, key string) string {
+	return makeKey(nsHist, dict, key)
+}
+
+func keyBulk(uuid string) string {
+	return makeKey(nsBulk, uuid)
+}
+
+func putAudit(v []auditItem, a actor) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	err := sendAudit(c.Send, v, a)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("")
+	return err
+}
+
+// sendAudit queues audit records (inside MULTI of writeDict they are
+// committed together with changes)
+func sendAudit(send func(string, ...interface{}) error, v []auditItem, a actor) error {
+	t := time.Now()
+	var (
+		b   []byte
+		err error
+	)
+	for i := range v {
+		v[i].Auth = a.auth
+		v[i].UUID = a.uuid
+		v[i].Time = t.String()
+		v[i].Unix = t.Unix()
+
+		b, err = json.Marshal(v[i])
+		if err != nil {
+			return err
+		}
+
+		k := keyHist(v[i].Dict, v[i].Key)
+		err = send("LPUSH", k, b)
+		if err != nil {
+			return err
+		}
+		err = send("LTRIM", k, 0, histN-1)
+		if err != nil {
+			return err
+		}
+
+		if a.uuid == "" {
+			continue
+		}
+		err = send("RPUSH", keyBulk(a.uuid), b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.uuid != "" && len(v) > 0 {
+		return send("EXPIRE", keyBulk(a.uuid), bulkTTL)
+	}
+
+	return nil
+}
+
+func readAudit(k string) ([]auditItem, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	r, err := redis.Strings(c.Do("LRANGE", k, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]auditItem, len(r))
+	for i := range r {
+		err = json.Unmarshal([]byte(r[i]), &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func findAudit(q auditQuery) ([]auditItem, error) {
+	if q.UUID != "" {
+		return readAudit(keyBulk(q.UUID))
+	}
+
+	_, _, err := dictKey(q.Dict, q.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return readAudit(keyHist(q.Dict, q.Key))
+}
+
+// GetHist returns audit records of a key (newest first) or of a request (in order).
+// JSON object: {"dict":"drug","key":"key1"} or {"uuid":"..."}
+func GetHist(data []byte) (interface{}, error) {
+	q := auditQuery{}
+	err := json.Unmarshal(data, &q)
+	if err != nil {
+		return nil, err
+	}
+
+	return findAudit(q)
+}
+
+// Undo rolls back a key to its previous state (or to the state before unix time)
+// or all changes made by a request (by request UUID). Keys changed after the
+// audited change are not rolled back (version conflict).
+// JSON object: {"dict":"drug","key":"key1","unix":0} or {"uuid":"..."}
+func Undo(data []byte, auth, uuid string) (interface{}, error) {
+	q := auditQuery{}
+	err := json.Unmarshal(data, &q)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := findAudit(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.UUID != "" {
+		// bulk is in order of writes, so roll back from the end
+		for i, j := 0, len(v)-1; i < j; i, j = i+1, j-1 {
+			v[i], v[j] = v[j], v[i]
+		}
+	} else {
+		v = undoTail(v, q.Unix)
+	}
+
+	if len(v) == 0 {
+		return nil, fmt.Errorf("core: nothing to undo")
+	}
+
+	ws := undoWrites(v)
+	all := 0
+	for _, w := range ws {
+		all += len(w.keys)
+	}
+
+	// dicts are rolled back one by one: report what is done on failure
+	a := actor{auth, uuid}
+	n := 0
+	for _, w := range ws {
+		err = writeDict(w, a)
+		if err != nil {
+			return nil, fmt.Errorf("core: %d of %d keys rolled back: %v", n, all, err)
+		}
+		n += len(w.keys)
+	}
+
+	return n, nil
+}
+
+// undoWrites groups records (in order of rollback) by dict, so changes of
+// a dict are rolled back at once: each key gets old value of its earliest
+// record if it still holds new value of its latest one
+func undoWrites(v []auditItem) []*dictWrite {
+	var (
+		out  []*dictWrite
+		dict = make(map[string]*dictWrite)
+		keys = make(map[string]int)
+	)
+	for i := range v {
+		w, ok := dict[v[i].Dict]
+		if !ok {
+			w = &dictWrite{dict: v[i].Dict}
+			dict[v[i].Dict] = w
+			out = append(out, w)
+		}
+
+		k := v[i].Dict + ":" + v[i].Key
+		if j, ok := keys[k]; ok {
+			w.vals[j] = v[i].Old
+			continue
+		}
+		keys[k] = len(w.keys)
+		w.keys = append(w.keys, v[i].Key)
+		w.vals = append(w.vals, v[i].Old)
+		w.want = append(w.want, v[i].New)
+	}
+	return out
+}
+
+// undoTail returns the oldest record made since unix time (its old value is
+// the state before that time) or the latest record if unix is zero
+func undoTail(v []auditItem, unix int64) []auditItem {
+	if unix == 0 {
+		if len(v) > 1 {
+			return v[:1]
+		}
+		return v
+	}
+
+	n := 0
+	for n < len(v) && v[n].Unix >= unix {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	return v[n-1 : n]
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:barc:"+GTIN (14 digits)
+// HMSET key l/v d/v b/v c/v s/v (same as drug link) v/version
+// JSON array: [{"id":"4820000000000","id_link":1,"id_drug":2,"id_brnd":3,"id_catg":4,"id_stat":0}]
+const (
+	dictBarc = "barc"
+	nsBarc   = "barc"
+
+	matchBarc = "barcode"
+)
+
+func keyBarc(gtin string) string {
+	return makeKey(nsBarc, gtin)
+}
+
+// normGTIN returns GTIN-8/12/13/14 padded with zeros to 14 digits
+// or "" if barcode is invalid
+func normGTIN(s string) string {
+	s = strings.TrimSpace(s)
+	switch len(s) {
+	case 8, 12, 13, 14:
+	default:
+		return ""
+	}
+
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+
+	s = strings.Repeat("0", 14-len(s)) + s
+	if !testGTIN(s) {
+		return ""
+	}
+
+	return s
+}
+
+// testGTIN checks control digit (mod 10) of 14 digits code
+func testGTIN(s string) bool {
+	n := 0
+	for i := 0; i < len(s)-1; i++ {
+		d := int(s[i] - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		n += d
+	}
+	return (10-n%10)%10 == int(s[len(s)-1]-'0')
+}
+
+func normGTINs(v []string) ([]string, error) {
+	out := make([]string, len(v))
+	for i := range v {
+		out[i] = normGTIN(v[i])
+		if out[i] == "" {
+			return nil, fmt.Errorf("core: invalid barcode %s", v[i])
+		}
+	}
+	return out, nil
+}
+
+func getLinkBarc(v []string) ([]linkDrug, error) {
+	return getLinkDrugBy(keyBarc, v)
+}
+
+// GetBarc returns drug links by barcodes.
+// JSON array: ["4820000000000"]
+func GetBarc(data []byte) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err = normGTINs(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return getLinkBarc(v)
+}
+
+// SetBarc replaces drug links of barcodes, "vers" is optional expected version.
+func SetBarc(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkDrug
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: dictBarc,
+		keys: make([]string, len(v)),
+		vals: make([]map[string]string, len(v)),
+		vers: make([]int64, len(v)),
+	}
+	for i := range v {
+		w.keys[i] = v[i].ID
+		w.vals[i] = v[i].hash()
+		w.vers[i] = v[i].Vers
+	}
+
+	w.keys, err = normGTINs(w.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
+
+// DelBarc deletes drug links of barcodes.
+// JSON array: ["4820000000000"]
+func DelBarc(data []byte, auth, uuid string) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err = normGTINs(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(&dictWrite{dict: dictBarc, keys: v}, actor{auth, uuid})
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"internal/net/nats"
+)
+
+// In-process LRU/TTL cache of drug and addr links (misses are cached too).
+// Writes of dictionaries drop keys from local cache and publish them
+// to subjectCache, so other instances drop them as well. Lookups which
+// overlap a drop are not cached (they may have read the old value) and
+// cache is cleared when NATS connection is restored (drops published
+// while it was lost are not delivered).
+// Hit and miss counters are exported by expvar (/debug/vars, "m12.cache").
+const (
+	subjectCache = "m12.cache"
+
+	cacheSize = 200000
+	cacheTTL  = 10 * time.Minute
+)
+
+type cacheItem struct {
+	key  string
+	val  interface{}
+	time time.Time
+}
+
+type linkCache struct {
+	sync.Mutex
+	size int
+	ttl  time.Duration
+	gen  uint64 // counter of drops
+	list *list.List
+	item map[string]*list.Element
+	hits *expvar.Int
+	miss *expvar.Int
+}
+
+type cacheDrop struct {
+	Dict string   `json:"dict"`
+	Keys []string `json:"keys"`
+}
+
+var (
+	cacheVars = expvar.NewMap("m12.cache")
+	cacheDrug = newLinkCache(dictDrug, cacheSize, cacheTTL)
+	cacheAddr = newLinkCache(dictAddr, cacheSize, cacheTTL)
+)
+
+func newLinkCache(dict string, size int, ttl time.Duration) *linkCache {
+	c := &linkCache{
+		size: size,
+		ttl:  ttl,
+		list: list.New(),
+		item: make(map[string]*list.Element),
+		hits: new(expvar.Int),
+		miss: new(expvar.Int),
+	}
+	cacheVars.Set(dict+".hits", c.hits)
+	cacheVars.Set(dict+".miss", c.miss)
+	return c
+}
+
+func (c *linkCache) get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.item[key]
+	if ok && time.Since(e.Value.(*cacheItem).time) > c.ttl {
+		c.list.Remove(e)
+		delete(c.item, key)
+		ok = false
+	}
+	if !ok {
+		c.miss.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	c.list.MoveToFront(e)
+	return e.Value.(*cacheItem).val, true
+}
+
+// generation returns counter of drops to be passed to put of looked up values
+func (c *linkCache) generation() uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.gen
+}
+
+// put skips value if any key was dropped since gen (value may be stale)
+func (c *linkCache) put(gen uint64, key string, val interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if e, ok := c.item[key]; ok {
+		e.Value = &cacheItem{key, val, time.Now()}
+		c.list.MoveToFront(e)
+		return
+	}
+
+	c.item[key] = c.list.PushFront(&cacheItem{key, val, time.Now()})
+	for c.list.Len() > c.size {
+		e := c.list.Back()
+		c.list.Remove(e)
+		delete(c.item, e.Value.(*cacheItem).key)
+	}
+}
+
+func (c *linkCache) del(keys ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gen++
+	for _, k := range keys {
+		if e, ok := c.item[k]; ok {
+			c.list.Remove(e)
+			delete(c.item, k)
+		}
+	}
+}
+
+func (c *linkCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gen++
+	c.list.Init()
+	c.item = make(map[string]*list.Element)
+}
+
+// clearCache clears caches of all dictionaries
+func clearCache() {
+	cacheDrug.clear()
+	cacheAddr.clear()
+}
+
+func getCache(dict string) *linkCache {
+	switch dict {
+	case dictDrug:
+		return cacheDrug
+	case dictAddr:
+		return cacheAddr
+	}
+	return nil
+}
+
+// dropCache drops keys of dict locally and on other instances
+func dropCache(dict string, keys []string) {
+	c := getCache(dict)
+	if c == nil || len(keys) == 0 {
+		return
+	}
+	c.del(keys...)
+
+	d, err := json.Marshal(cacheDrop{dict, keys})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = nats.Publish(subjectCache, d)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// procCache drops keys published by other instances
+func procCache(data []byte) {
+	v := cacheDrop{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if c := getCache(v.Dict); c != nil {
+		c.del(v.Keys...)
+	}
+}
+
+// getLinkDrugCache is getLinkDrug in front of cache
+func getLinkDrugCache(v []string) ([]linkDrug, error) {
+	out := make([]linkDrug, len(v))
+	var (
+		rows []int
+		look []string
+	)
+	for i := range v {
+		if l, ok := cacheDrug.get(v[i]); ok {
+			out[i] = l.(linkDrug)
+			continue
+		}
+		rows = append(rows, i)
+		look = append(look, v[i])
+	}
+
+	if len(look) == 0 {
+		return out, nil
+	}
+
+	g := cacheDrug.generation()
+	l, err := getLinkDrug(look)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range rows {
+		out[i] = l[j]
+		cacheDrug.put(g, v[i], l[j])
+	}
+
+	return out, nil
+}
+
+// getLinkAddrCache is getLinkAddr in front of cache
+func getLinkAddrCache(v []string) ([]linkAddr, error) {
+	out := make([]linkAddr, len(v))
+	var (
+		rows []int
+		look []string
+	)
+	for i := range v {
+		if l, ok := cacheAddr.get(v[i]); ok {
+			out[i] = l.(linkAddr)
+			continue
+		}
+		rows = append(rows, i)
+		look = append(look, v[i])
+	}
+
+	if len(look) == 0 {
+		return out, nil
+	}
+
+	g := cacheAddr.generation()
+	l, err := getLinkAddr(look)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range rows {
+		out[i] = l[j]
+		cacheAddr.put(g, v[i], l[j])
+	}
+
+	return out, nil
+}
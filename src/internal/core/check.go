@@ -0,0 +1,466 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"internal/database/redis"
+)
+
+// Kinds of problems found by Check: empty (link hash without link fields
+// left by partial writes), orphan (reference to unknown stat, auth, drug
+// or addr), conflict (keys of the same canonical notation linked to
+// different IDDrug), stale (key which does not match current normalizer).
+// Safe fixes (with "fix") delete empty hashes and orphaned references,
+// conflicts and stale keys are reported only.
+const (
+	checkEmpty    = "empty"
+	checkOrphan   = "orphan"
+	checkConflict = "conflict"
+	checkStale    = "stale"
+
+	checkLimit = 100
+	checkActor = "check"
+)
+
+type checkOpts struct {
+	Fix   bool `json:"fix,omitempty"`
+	Scan  int  `json:"scan,omitempty"`
+	Limit int  `json:"limit,omitempty"`
+}
+
+type checkItem struct {
+	Kind string `json:"kind"`
+	Dict string `json:"dict"`
+	Key  string `json:"key"`
+	Info string `json:"info,omitempty"`
+}
+
+type checkStat struct {
+	Fix   bool             `json:"fix,omitempty"`
+	Keys  map[string]int64 `json:"keys,omitempty"`  // scanned entries per dict
+	Found map[string]int64 `json:"found,omitempty"` // problems per kind
+	Fixed map[string]int64 `json:"fixed,omitempty"` // fixed problems per kind
+	List  []checkItem      `json:"list,omitempty"`  // first problems (limit)
+	Notes []string         `json:"notes,omitempty"` // limits of checks
+
+	opts  checkOpts
+	stat  map[string]bool
+	auth  map[string]bool
+	links map[string]map[string]int64 // dict -> key -> IDDrug (or IDLink) of non-empty links
+}
+
+func (s *checkStat) add(kind, dict, key, info string) {
+	s.Found[kind]++
+	if len(s.List) < s.opts.Limit {
+		s.List = append(s.List, checkItem{kind, dict, key, info})
+	}
+}
+
+// Check scans dictionaries and reports (and fixes with "fix") problems.
+// JSON object: {"fix":false,"scan":1000,"limit":100}
+func Check(data []byte) (interface{}, error) {
+	o := checkOpts{}
+	if len(data) > 0 {
+		err := json.Unmarshal(data, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Scan <= 0 {
+		o.Scan = migrScan
+	}
+	if o.Limit <= 0 {
+		o.Limit = checkLimit
+	}
+
+	s := &checkStat{
+		Fix:   o.Fix,
+		Keys:  make(map[string]int64),
+		Found: make(map[string]int64),
+		Fixed: make(map[string]int64),
+		opts:  o,
+		links: make(map[string]map[string]int64),
+	}
+
+	var err error
+	s.stat, err = hashFields(keyStat())
+	if err != nil {
+		return nil, err
+	}
+
+	s.auth, err = hashFields(keyAuth())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range []func(*checkStat) error{
+		checkDrugs,
+		checkAddrs,
+		checkBarcs,
+		checkIndex,
+		checkXwlks,
+		checkAuths,
+		checkMagics,
+	} {
+		err = f(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// hashFields returns set of fields of hash
+func hashFields(key string) (map[string]bool, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	r, err := redis.Strings(c.Do("HKEYS", key))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]bool, len(r))
+	for i := range r {
+		out[r[i]] = true
+	}
+
+	return out, nil
+}
+
+// scanHash calls f with field/value pairs of hash
+func scanHash(n int, key string, f func([]string) error) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	cur := "0"
+	for {
+		r, err := redis.Intfs(c.Do("HSCAN", key, cur, "COUNT", n))
+		if err != nil {
+			return err
+		}
+		if len(r) != 2 {
+			return nil
+		}
+
+		cur, _ = redis.String(r[0], nil)
+		kv, err := redis.Strings(r[1], nil)
+		if err != nil {
+			return err
+		}
+
+		err = f(kv)
+		if err != nil {
+			return err
+		}
+
+		if cur == "0" {
+			return nil
+		}
+	}
+}
+
+func checkDrugs(s *checkStat) error {
+	return checkLinks(s, dictDrug, keyDrug(""), fldsDrug, 1, 4)
+}
+
+func checkAddrs(s *checkStat) error {
+	return checkLinks(s, dictAddr, keyAddr(""), fldsAddr, 0, 3)
+}
+
+func checkBarcs(s *checkStat) error {
+	return checkLinks(s, dictBarc, keyBarc(""), fldsDrug, 1, 4)
+}
+
+// checkLinks finds empty link hashes and links to unknown stat,
+// id and stat are positions of remembered ID and IDStat in flds
+func checkLinks(s *checkStat, dict, prefix string, flds []interface{}, id, stat int) error {
+	s.links[dict] = make(map[string]int64)
+	return scanKeys(s.opts.Scan, prefix+"*", func(keys []string) error {
+		c := redis.Conn()
+		defer redis.Free(c)
+
+		vls := make([]interface{}, 0, len(flds)+1)
+		var err error
+		for i := range keys {
+			vls = append(vls[:0], keys[i])
+			vls = append(vls, flds...)
+			err = c.Send("HMGET", vls...)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = c.Flush()
+		if err != nil {
+			return err
+		}
+
+		var empty []string
+		for i := range keys {
+			r, err := redis.Strings(c.Receive())
+			if err != nil && redis.NotErrNil(err) {
+				return err
+			}
+			k := strings.TrimPrefix(keys[i], prefix)
+			s.Keys[dict]++
+
+			if isEmptyLink(r) {
+				s.add(checkEmpty, dict, k, "")
+				empty = append(empty, k)
+				continue
+			}
+
+			s.links[dict][k], _ = strconv.ParseInt(r[id], 10, 64)
+			if r[stat] != "" && !s.stat[r[stat]] {
+				s.add(checkOrphan, dict, k, "id_stat "+r[stat])
+			}
+		}
+
+		if !s.Fix || len(empty) == 0 {
+			return nil
+		}
+
+		err = writeDict(&dictWrite{dict: dict, keys: empty}, actor{auth: checkActor})
+		if err == nil {
+			s.Fixed[checkEmpty] += int64(len(empty))
+		}
+		return err
+	})
+}
+
+// isEmptyLink returns true if all link fields are empty (version is not a link field)
+func isEmptyLink(r []string) bool {
+	for i := 0; i < len(r)-1; i++ {
+		if r[i] != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkIndex finds entries of notation indexes pointing to unknown links
+func checkIndex(s *checkStat) error {
+	err := checkHashRefs(s, "norm", keyNorm(), s.links[dictDrug])
+	if err != nil {
+		return err
+	}
+	return checkHashRefs(s, "nadr", keyNadr(), s.links[dictAddr])
+}
+
+func checkHashRefs(s *checkStat, dict, key string, links map[string]int64) error {
+	var miss []interface{}
+	err := scanHash(s.opts.Scan, key, func(kv []string) error {
+		for i := 0; i+1 < len(kv); i += 2 {
+			s.Keys[dict]++
+			if _, ok := links[kv[i+1]]; !ok {
+				s.add(checkOrphan, dict, kv[i], "id "+kv[i+1])
+				miss = append(miss, kv[i])
+			}
+		}
+		return nil
+	})
+	if err != nil || !s.Fix || len(miss) == 0 {
+		return err
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	_, err = c.Do("HDEL", append([]interface{}{key}, miss...)...)
+	if err == nil {
+		s.Fixed[checkOrphan] += int64(len(miss))
+	}
+	return err
+}
+
+// checkXwlks finds crosswalks of unknown auth and entries pointing to unknown drugs
+func checkXwlks(s *checkStat) error {
+	prefix := keyXwlk("")
+	var keys []string
+	err := scanKeys(s.opts.Scan, prefix+"*", func(v []string) error {
+		keys = append(keys, v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		auth := strings.TrimPrefix(keys[i], prefix)
+		if !s.auth[auth] {
+			s.add(checkOrphan, dictXwlk, auth, "auth")
+		}
+
+		var miss []string
+		err = scanHash(s.opts.Scan, keys[i], func(kv []string) error {
+			for j := 0; j+1 < len(kv); j += 2 {
+				s.Keys[dictXwlk]++
+				if _, ok := s.links[dictDrug][kv[j+1]]; !ok {
+					s.add(checkOrphan, dictXwlk, xwlkKey(auth, kv[j]), "id "+kv[j+1])
+					miss = append(miss, xwlkKey(auth, kv[j]))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !s.Fix || len(miss) == 0 {
+			continue
+		}
+
+		err = writeDict(&dictWrite{dict: dictXwlk, keys: miss}, actor{auth: checkActor})
+		if err != nil {
+			return err
+		}
+		s.Fixed[checkOrphan] += int64(len(miss))
+	}
+
+	return nil
+}
+
+// checkAuths finds statuses and enrichment rules of unknown auth keys and unknown stat
+func checkAuths(s *checkStat) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	r, err := redis.StringMap(c.Do("HGETALL", keyAuthStat()))
+	if err != nil {
+		return err
+	}
+
+	var miss []string
+	for k, v := range r {
+		s.Keys[dictAuthStat]++
+		switch {
+		case !s.auth[k]:
+			s.add(checkOrphan, dictAuthStat, k, "auth")
+		case !s.stat[v]:
+			s.add(checkOrphan, dictAuthStat, k, "id_stat "+v)
+		default:
+			continue
+		}
+		miss = append(miss, k)
+	}
+
+	if s.Fix && len(miss) != 0 {
+		err = writeDict(&dictWrite{dict: dictAuthStat, keys: miss}, actor{auth: checkActor})
+		if err != nil {
+			return err
+		}
+		s.Fixed[checkOrphan] += int64(len(miss))
+	}
+
+	r, err = redis.StringMap(c.Do("HGETALL", keyRich()))
+	if err != nil {
+		return err
+	}
+
+	miss = miss[:0]
+	for k := range r {
+		s.Keys[dictRich]++
+		if !strings.HasPrefix(k, richRoute) && !s.auth[k] {
+			s.add(checkOrphan, dictRich, k, "auth")
+			miss = append(miss, k)
+		}
+	}
+
+	if s.Fix && len(miss) != 0 {
+		err = writeDict(&dictWrite{dict: dictRich, keys: miss}, actor{auth: checkActor})
+		if err != nil {
+			return err
+		}
+		s.Fixed[checkOrphan] += int64(len(miss))
+	}
+
+	return nil
+}
+
+// checkMagics finds stale keys and conflicts of canonical notations of known
+// names, only names of fuzzy catalogue are known (see BuildFuzz)
+func checkMagics(s *checkStat) error {
+	seen := make(map[string]string) // canonical notation -> drug key
+	cover := make(map[string]int)   // dict -> number of linked keys of catalogue
+	err := scanHash(s.opts.Scan, keyMags(dictDrug), func(kv []string) error {
+		for i := 0; i+1 < len(kv); i += 2 {
+			k, m := kv[i], kv[i+1]
+			s.Keys["mags:"+dictDrug]++
+			if s.links[dictDrug][k] != 0 {
+				cover[dictDrug]++
+			}
+
+			name, suffix := splitMagicSuffix(m)
+			if strToSHA1(makeMagicDrug(name)+suffix) != k {
+				s.add(checkStale, dictDrug, k, m)
+			}
+
+			n := parseDrugName(name).canon()
+			d := s.links[dictDrug][k]
+			if n == "" || d == 0 {
+				continue
+			}
+
+			n += suffix
+			o, ok := seen[n]
+			if !ok {
+				seen[n] = k
+				continue
+			}
+			if e := s.links[dictDrug][o]; e != d {
+				s.add(checkConflict, dictDrug, k, fmt.Sprintf("%s: id_drug %d, %s: id_drug %d", n, d, o, e))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanHash(s.opts.Scan, keyMags(dictAddr), func(kv []string) error {
+		for i := 0; i+1 < len(kv); i += 2 {
+			s.Keys["mags:"+dictAddr]++
+			if s.links[dictAddr][kv[i]] != 0 {
+				cover[dictAddr]++
+			}
+			if strToSHA1(makeMagicAddr(kv[i+1])) != kv[i] {
+				s.add(checkStale, dictAddr, kv[i], kv[i+1])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, d := range []string{dictDrug, dictAddr} {
+		n := 0
+		for _, id := range s.links[d] {
+			if id != 0 {
+				n++
+			}
+		}
+		if cover[d] < n {
+			s.Notes = append(s.Notes, fmt.Sprintf(
+				"names of %s are checked for catalogued keys only: %d of %d linked keys, run \"fuzz\" to backfill catalogue",
+				d, cover[d], n))
+		}
+	}
+
+	return nil
+}
+
+// splitMagicSuffix splits magic of drug into name and country suffix
+func splitMagicSuffix(m string) (string, string) {
+	for _, s := range []string{magicSuffixBY, magicSuffixKZ, magicSuffixRU} {
+		if strings.HasSuffix(m, s) {
+			return strings.TrimSuffix(m, s), s
+		}
+	}
+	return m, ""
+}
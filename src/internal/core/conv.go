@@ -46,6 +46,7 @@ func convSale(data []byte, m *meta) (jsonV3Sale, error) {
 	for i, v := range v.Data[0].Item {
 		d[i].ID = v.Code
 		d[i].Name = v.Drug
+		d[i].Barcode = v.Barcode
 		d[i].QuantIn = v.QuantInp
 		d[i].PriceIn = v.PriceInp
 		d[i].QuantOut = v.QuantOut
@@ -96,6 +97,7 @@ func convSaleBy(data []byte, m *meta) (jsonV3SaleBy, error) {
 	for i, v := range v.Data[0].Item {
 		d[i].ID = v.Code
 		d[i].Name = v.Drug
+		d[i].Barcode = v.Barcode
 		d[i].QuantIn = v.QuantInp
 		d[i].PriceIn = v.PriceInp
 		d[i].QuantOut = v.QuantOut
@@ -153,6 +155,7 @@ func convGeoa(data []byte, m *meta) (jsonV3Geoa, error) {
 			d[i].ID = v.Code
 		}
 		d[i].Name = v.Name
+		d[i].Barcode = v.Barcode
 		d[i].Home = v.Link
 		if v.Addr != "" {
 			d[i].Home = v.Addr
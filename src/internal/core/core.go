@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"internal/core/pref"
 	"internal/database/minio"
 	"internal/net/nats"
 )
@@ -35,12 +36,42 @@ type path struct {
 
 // Init inits package
 func Init() error {
-	initBuckets(bucketStreamIn, bucketStreamErr, bucketStreamOut, bucketStreamOutGeo /*bucketStreamOutGeoTest,*/, bucketStreamOutFrwd)
+	err := testKeyScheme()
+	if err != nil {
+		return err
+	}
+
+	err = initCrypt()
+	if err != nil {
+		return err
+	}
+
+	err = testCodec(pref.Codec)
+	if err != nil {
+		return err
+	}
+
+	initBuckets(bucketStreamIn, bucketStreamErr, bucketStreamOut, bucketStreamOutGeo /*bucketStreamOutGeoTest,*/, bucketStreamOutFrwd, bucketRcgnIn, bucketRcgnOut, bucketArchive)
 	sendMessage(bucketStreamOut, subjectSteamOut, tickD, listN)
 	sendMessage(bucketStreamIn, subjectSteamIn, tickD, listN)
 	sendMessage(bucketStreamOutGeo, subjectSteamOutGeo, tickD, listN)
+	sendMessage(bucketRcgnIn, subjectRcgnIn, tickD, listN)
 	//sendMessage(bucketStreamOutGeoTest, subjectSteamOutGeoTest, tickD, listN)
 	trimZLog(tickD*60, trimD)
+	trimArch(archTick)
+	trimRetn(retnTick)
+
+	err = nats.Subscribe(subjectCache, procCache)
+	if err != nil {
+		return err
+	}
+	nats.OnReconnect(clearCache)
+
+	err = nats.Subscribe(subjectRcgnIn, procJob)
+	if err != nil {
+		return err
+	}
+
 	return nats.Subscribe(subjectSteamIn, proc)
 }
 
@@ -57,7 +88,7 @@ func initBuckets(b ...string) error {
 
 func sendMessage(b, s string, d time.Duration, n int) {
 	_ = time.AfterFunc(d, func() {
-		l, err := minio.List(b, n)
+		l, err := minio.Scan(b, "", true, n) // flat and hierarchical names
 		if err != nil {
 			log.Println(err)
 		} else {
@@ -0,0 +1,475 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"internal/core/pref"
+	"internal/database/minio"
+)
+
+// Envelope encryption of packages: every package gets random AES-256 data
+// key which encrypts members (AES-256-GCM, member name is authenticated),
+// data key is wrapped by master key and stored in manifest with master
+// key ID. Master keys are "id:base64" entries (32 bytes), comma separated
+// in pref.CryptKey (or M12_CRYPTKEY) or one per line in pref.CryptKeyFile,
+// the first one encrypts new packages, others decrypt old ones (rotation).
+// Without master keys packages are written in plain.
+const cryptAlg = "AES-256-GCM"
+
+type packCrypt struct {
+	Alg   string `json:"alg"`
+	KeyID string `json:"kid"`
+	Key   string `json:"key"` // wrapped data key, base64
+}
+
+type cryptKey struct {
+	id  string
+	key []byte
+}
+
+var cryptKeys struct {
+	sync.Mutex
+	list []cryptKey
+	init bool
+}
+
+// initCrypt loads master keys
+func initCrypt() error {
+	cryptKeys.Lock()
+	defer cryptKeys.Unlock()
+
+	s := strings.Split(pref.CryptKey, ",")
+
+	if pref.CryptKeyFile != "" {
+		b, err := ioutil.ReadFile(pref.CryptKeyFile)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewScanner(bytes.NewReader(b))
+		for r.Scan() {
+			s = append(s, r.Text())
+		}
+	}
+
+	var list []cryptKey
+	seen := make(map[string]bool)
+	for _, v := range s {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.HasPrefix(v, "#") {
+			continue
+		}
+		k, err := parseCryptKey(v)
+		if err != nil {
+			return err
+		}
+		if seen[k.id] {
+			return fmt.Errorf("core: duplicate crypt key %s", k.id)
+		}
+		seen[k.id] = true
+		list = append(list, k)
+	}
+
+	cryptKeys.list = list
+	cryptKeys.init = true
+
+	return nil
+}
+
+func parseCryptKey(s string) (cryptKey, error) {
+	p := strings.SplitN(s, ":", 2)
+	if len(p) != 2 || p[0] == "" {
+		return cryptKey{}, fmt.Errorf("core: invalid crypt key, want id:base64")
+	}
+	b, err := base64.StdEncoding.DecodeString(p[1])
+	if err != nil || len(b) != 32 {
+		return cryptKey{}, fmt.Errorf("core: invalid crypt key %s, want 32 bytes", p[0])
+	}
+	return cryptKey{p[0], b}, nil
+}
+
+func getCryptKeys() ([]cryptKey, error) {
+	cryptKeys.Lock()
+	ok := cryptKeys.init
+	cryptKeys.Unlock()
+
+	if !ok {
+		err := initCrypt()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cryptKeys.Lock()
+	defer cryptKeys.Unlock()
+
+	return cryptKeys.list, nil
+}
+
+// findCryptKey returns master key by ID (current key if id is empty, nil if none)
+func findCryptKey(id string) ([]byte, string, error) {
+	l, err := getCryptKeys()
+	if err != nil || len(l) == 0 {
+		return nil, "", err
+	}
+	if id == "" {
+		return l[0].key, l[0].id, nil
+	}
+	for i := range l {
+		if l[i].id == id {
+			return l[i].key, id, nil
+		}
+	}
+	return nil, "", fmt.Errorf("core: unknown crypt key %s", id)
+}
+
+func sealData(key, data, ad []byte) ([]byte, error) {
+	g, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	n := make([]byte, g.NonceSize(), g.NonceSize()+len(data)+g.Overhead())
+	_, err = io.ReadFull(rand.Reader, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.Seal(n, n, data, ad), nil
+}
+
+func openData(key, data, ad []byte) ([]byte, error) {
+	g, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < g.NonceSize() {
+		return nil, fmt.Errorf("core: invalid encrypted data")
+	}
+
+	return g.Open(nil, data[:g.NonceSize()], data[g.NonceSize():], ad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// newDataKey returns new data key wrapped by current master key (nil if encryption is off)
+func newDataKey() ([]byte, *packCrypt, error) {
+	m, id, err := findCryptKey("")
+	if err != nil || m == nil {
+		return nil, nil, err
+	}
+
+	k := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := wrapDataKey(k, m, id)
+	return k, c, err
+}
+
+func wrapDataKey(k, m []byte, id string) (*packCrypt, error) {
+	w, err := sealData(m, k, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return &packCrypt{Alg: cryptAlg, KeyID: id, Key: base64.StdEncoding.EncodeToString(w)}, nil
+}
+
+// dataKey unwraps data key of manifest
+func (c *packCrypt) dataKey() ([]byte, error) {
+	if c.Alg != cryptAlg {
+		return nil, fmt.Errorf("core: unsupported crypt %s", c.Alg)
+	}
+
+	m, _, err := findCryptKey(c.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("core: no crypt key to decrypt package (key %s)", c.KeyID)
+	}
+
+	w, err := base64.StdEncoding.DecodeString(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openData(m, w, []byte(c.KeyID))
+}
+
+type cryptStat struct {
+	Time    string           `json:"time,omitempty"`
+	Proc    string           `json:"proc,omitempty"`
+	Running bool             `json:"running"`
+	KeyID   string           `json:"kid"`
+	Dry     bool             `json:"dry,omitempty"`
+	Keys    map[string]int64 `json:"keys,omitempty"`    // scanned objects per bucket
+	Done    map[string]int64 `json:"done,omitempty"`    // reencrypted objects per bucket
+	Skip    map[string]int64 `json:"skip,omitempty"`    // objects which are not packages
+	Current map[string]int64 `json:"current,omitempty"` // objects already under current key
+	Changed map[string]int64 `json:"changed,omitempty"` // objects removed or replaced during run
+	Fail    string           `json:"fail,omitempty"`
+}
+
+// cryptRun is report of running (or last) reencryption
+var cryptRun struct {
+	sync.Mutex
+	stat *cryptStat
+}
+
+// Reencrypt starts reencryption in background (see ReencryptNow), progress
+// and result are returned by GetReencryptStat.
+// JSON object: {"bucket":["stream-out"],"dry":false}
+func Reencrypt(data []byte) (interface{}, error) {
+	s, v, err := newCryptRun(data)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := runReencrypt(s, v)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return GetReencryptStat()
+}
+
+// ReencryptNow rewraps data keys of packages by current master key and
+// encrypts plain packages (all buckets except transient stream-in and
+// rcgn-in if empty), returns report when done.
+// JSON object: {"bucket":["stream-out"],"dry":false}
+func ReencryptNow(data []byte) (interface{}, error) {
+	s, v, err := newCryptRun(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runReencrypt(s, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetReencryptStat()
+}
+
+// GetReencryptStat returns report of running or last reencryption
+func GetReencryptStat() (interface{}, error) {
+	cryptRun.Lock()
+	defer cryptRun.Unlock()
+
+	if cryptRun.stat == nil {
+		return cryptStat{}, nil
+	}
+
+	s := *cryptRun.stat
+	for _, m := range []*map[string]int64{&s.Keys, &s.Done, &s.Skip, &s.Current, &s.Changed} {
+		c := make(map[string]int64, len(*m))
+		for k, v := range *m {
+			c[k] = v
+		}
+		*m = c
+	}
+
+	return s, nil
+}
+
+type cryptOpts struct {
+	Bucket []string `json:"bucket,omitempty"`
+	Dry    bool     `json:"dry,omitempty"`
+}
+
+// newCryptRun registers new run unless another one is running
+func newCryptRun(data []byte) (*cryptStat, cryptOpts, error) {
+	v := cryptOpts{}
+	if len(data) > 0 {
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			return nil, v, err
+		}
+	}
+	if len(v.Bucket) == 0 {
+		v.Bucket = []string{bucketStreamOut, bucketStreamOutGeo, bucketStreamOutFrwd,
+			bucketStreamErr, bucketRcgnOut, bucketArchive}
+	}
+
+	_, id, err := findCryptKey("")
+	if err != nil {
+		return nil, v, err
+	}
+	if id == "" {
+		return nil, v, fmt.Errorf("core: no crypt key")
+	}
+
+	cryptRun.Lock()
+	defer cryptRun.Unlock()
+
+	if cryptRun.stat != nil && cryptRun.stat.Running {
+		return nil, v, fmt.Errorf("core: reencryption is running already")
+	}
+
+	cryptRun.stat = &cryptStat{
+		Time:    time.Now().String(),
+		Running: true,
+		KeyID:   id,
+		Dry:     v.Dry,
+		Keys:    make(map[string]int64),
+		Done:    make(map[string]int64),
+		Skip:    make(map[string]int64),
+		Current: make(map[string]int64),
+		Changed: make(map[string]int64),
+	}
+
+	return cryptRun.stat, v, nil
+}
+
+func runReencrypt(s *cryptStat, v cryptOpts) error {
+	t := time.Now()
+	err := walkReencrypt(s, v)
+
+	cryptRun.Lock()
+	defer cryptRun.Unlock()
+
+	if err != nil {
+		s.Fail = err.Error()
+	}
+	s.Proc = time.Since(t).String()
+	s.Running = false
+
+	return err
+}
+
+func walkReencrypt(s *cryptStat, v cryptOpts) error {
+	m, id, err := findCryptKey(s.KeyID)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range v.Bucket {
+		err = minio.Walk(b, "", func(o string) bool {
+			var r cryptResult
+			if strings.HasSuffix(o, ".tar") {
+				r, err = reencrypt(b, o, m, id, v.Dry)
+				if err != nil {
+					err = fmt.Errorf("core: %s/%s: %v", b, o, err)
+					return false
+				}
+			}
+
+			cryptRun.Lock()
+			defer cryptRun.Unlock()
+
+			s.Keys[b]++
+			switch {
+			case !strings.HasSuffix(o, ".tar"):
+				s.Skip[b]++
+			case r == cryptDone:
+				s.Done[b]++
+			case r == cryptCurrent:
+				s.Current[b]++
+			case r == cryptChanged:
+				s.Changed[b]++
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type cryptResult int
+
+const (
+	cryptDone    cryptResult = iota // reencrypted (or to be reencrypted if dry)
+	cryptCurrent                    // encrypted by current key already
+	cryptChanged                    // object is removed or replaced during reencryption
+)
+
+// reencrypt rewraps data key of package (encrypts plain package) by master
+// key id, object is written back only if it is not changed since it is read
+// (consumers may pop it and the enforcer may remove it meanwhile)
+func reencrypt(b, o string, m []byte, id string, dry bool) (cryptResult, error) {
+	t, err := minio.Stat(b, o)
+	if err != nil {
+		return cryptChanged, nil
+	}
+
+	f, err := minio.Get(b, o)
+	if err != nil {
+		return 0, err
+	}
+	p, err := readPack(f)
+	minio.Free(f)
+	if err != nil {
+		return 0, err
+	}
+
+	if fail := p.verify(); len(fail) != 0 {
+		return 0, fmt.Errorf("package is corrupted: %s", strings.Join(fail, ", "))
+	}
+
+	c := p.manifest.Crypt
+	if c != nil && c.KeyID == id {
+		return cryptCurrent, nil
+	}
+	if dry {
+		return cryptDone, nil
+	}
+
+	var r io.Reader
+	if c != nil {
+		var k []byte
+		k, err = c.dataKey()
+		if err != nil {
+			return 0, err
+		}
+		p.manifest.Crypt, err = wrapDataKey(k, m, id)
+		if err != nil {
+			return 0, err
+		}
+		r, err = p.write()
+	} else {
+		v := make([]packMember, len(p.manifest.Members))
+		for i, x := range p.manifest.Members {
+			v[i] = x
+			v[i].data = p.members[x.Name]
+			v[i].stored = true
+		}
+		r, err = writePack(v)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	x, err := minio.Stat(b, o)
+	if err != nil || !x.Equal(t) {
+		return cryptChanged, nil
+	}
+
+	return cryptDone, minio.Put(b, o, r)
+}
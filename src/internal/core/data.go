@@ -1,43 +1,61 @@
 package core
 
+import (
+	"strconv"
+)
+
+// Lookup methods of links
+const (
+	matchName = "name"
+	matchCode = "egrpou"
+	matchXwlk = "crosswalk"
+)
+
 // Redis scheme:
-// HASH => key="stat"
+// HASH => key="<prefix>:hset:auth"
 // HMSET key i->n [i->n...]
 // HMGET key i [i..]
 type linkAuth struct {
-	ID   string `json:"id,omitempty"   redis:"i"`
-	Name string `json:"name,omitempty" redis:"n"`
+	ID     string `json:"id,omitempty"      redis:"i"`
+	Name   string `json:"name,omitempty"    redis:"n"`
+	IDStat int64  `json:"id_stat,omitempty" redis:"-"` // stored in auth:stat
 }
 
 // Redis scheme:
-// HASH => key=ID (SHA1)
-// HMSET key l/v a/v s/v e/v (if exists in json)
-// HMGET key l a s e
+// HASH => key="<prefix>:addr:"+ID (SHA1)
+// HMSET key l/v a/v o/v s/v e/v (if exists in json) v/version (incremented on write)
+// HMGET key l a o s e v
 // JSON array: [{"id":"key1","id_link":1,"id_addr":2,"id_stat":0,"egrpou":"egrpou1"}]
 type linkAddr struct {
-	ID     string `json:"id,omitempty"      redis:"key"`
-	IDLink int64  `json:"id_link,omitempty" redis:"l"`
-	IDAddr int64  `json:"id_addr,omitempty" redis:"a"`
-	IDOrgn int64  `json:"id_orgn,omitempty" redis:"o"`
-	IDStat int64  `json:"id_stat,omitempty" redis:"s"`
-	EGRPOU string `json:"egrpou,omitempty"  redis:"e"`
+	ID     string     `json:"id,omitempty"      redis:"key"`
+	IDLink int64      `json:"id_link,omitempty" redis:"l"`
+	IDAddr int64      `json:"id_addr,omitempty" redis:"a"`
+	IDOrgn int64      `json:"id_orgn,omitempty" redis:"o"`
+	IDStat int64      `json:"id_stat,omitempty" redis:"s"`
+	EGRPOU string     `json:"egrpou,omitempty"  redis:"e"`
+	Vers   int64      `json:"vers,omitempty"    redis:"v"`
+	Match  string     `json:"match,omitempty"   redis:"-"` // lookup method, not stored
+	Names  *linkNames `json:"names,omitempty" redis:"-"`   // display names, not stored
 }
 
 // Redis scheme:
-// HASH => key=ID (SHA1)
-// HMSET key l/v d/v b/v c/v s/v (if exists in json)
-// HMGET key l d b c s
+// HASH => key="<prefix>:drug:"+ID (SHA1)
+// HMSET key l/v d/v b/v c/v s/v (if exists in json) v/version (incremented on write)
+// HMGET key l d b c s v
 type linkDrug struct {
-	ID     string `json:"id,omitempty"      redis:"key"`
-	IDLink int64  `json:"id_link,omitempty" redis:"l"`
-	IDDrug int64  `json:"id_drug,omitempty" redis:"d"`
-	IDBrnd int64  `json:"id_brnd,omitempty" redis:"b"`
-	IDCatg int64  `json:"id_catg,omitempty" redis:"c"`
-	IDStat int64  `json:"id_stat,omitempty" redis:"s"`
+	ID     string     `json:"id,omitempty"      redis:"key"`
+	IDLink int64      `json:"id_link,omitempty" redis:"l"`
+	IDDrug int64      `json:"id_drug,omitempty" redis:"d"`
+	IDBrnd int64      `json:"id_brnd,omitempty" redis:"b"`
+	IDCatg int64      `json:"id_catg,omitempty" redis:"c"`
+	IDStat int64      `json:"id_stat,omitempty" redis:"s"`
+	Vers   int64      `json:"vers,omitempty"    redis:"v"`
+	Match  string     `json:"match,omitempty"   redis:"-"` // lookup method, not stored
+	Names  *linkNames `json:"names,omitempty" redis:"-"`   // display names, not stored
 }
 
 // Redis scheme:
-// HASH => key="stat"
+// HASH => key="<prefix>:hset:stat"
 // HMSET key i->n [i->n...]
 // HMGET key i [i..]
 type linkStat struct {
@@ -45,57 +63,100 @@ type linkStat struct {
 	Name string `json:"name,omitempty" redis:"n"`
 }
 
+func (l linkAddr) hash() map[string]string {
+	h := make(map[string]string, len(fldsAddr))
+	putInt(h, "l", l.IDLink)
+	putInt(h, "a", l.IDAddr)
+	putInt(h, "o", l.IDOrgn)
+	putInt(h, "s", l.IDStat)
+	putStr(h, "e", l.EGRPOU)
+	return h
+}
+
+func (l linkDrug) hash() map[string]string {
+	h := make(map[string]string, len(fldsDrug))
+	putInt(h, "l", l.IDLink)
+	putInt(h, "d", l.IDDrug)
+	putInt(h, "b", l.IDBrnd)
+	putInt(h, "c", l.IDCatg)
+	putInt(h, "s", l.IDStat)
+	return h
+}
+
+func putInt(h map[string]string, k string, v int64) {
+	if v != 0 {
+		h[k] = strconv.FormatInt(v, 10)
+	}
+}
+
+func putStr(h map[string]string, k string, v string) {
+	if v != "" {
+		h[k] = v
+	}
+}
+
 type itemRcgnAddr struct {
-	ID   string   `json:"id,omitempty"`
-	Name string   `json:"name,omitempty"`
-	Head string   `json:"head,omitempty"`
-	Addr string   `json:"addr,omitempty"`
-	Code string   `json:"code,omitempty"`
-	Link linkAddr `json:"link,omitempty"`
+	ID     string     `json:"id,omitempty"`
+	Name   string     `json:"name,omitempty"`
+	Head   string     `json:"head,omitempty"`
+	Addr   string     `json:"addr,omitempty"`
+	Code   string     `json:"code,omitempty"`
+	Parsed *addrParts `json:"parsed,omitempty"`
+	Link   linkAddr   `json:"link,omitempty"`
+	Expl   *linkExpl  `json:"explain,omitempty"`
 }
 
 type itemRcgnDrug struct {
-	ID   string   `json:"id,omitempty"`
-	Name string   `json:"name,omitempty"`
-	Link linkDrug `json:"link,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Barcode string    `json:"barcode,omitempty"`
+	Parsed  *drugName `json:"parsed,omitempty"`
+	Link    linkDrug  `json:"link,omitempty"`
+	Expl    *linkExpl `json:"explain,omitempty"`
 }
 
 type itemV3Geoa struct {
-	ID     string   `json:"id,omitempty"`
-	Name   string   `json:"name,omitempty"`
-	Home   string   `json:"home,omitempty"` // formerly link
-	Quant  float64  `json:"quant,omitempty"`
-	Price  float64  `json:"price,omitempty"`
-	PriceC float64  `json:"price_cntr,omitempty"`
-	Link   linkDrug `json:"link,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Barcode string    `json:"barcode,omitempty"` // EAN-13/GTIN
+	Home    string    `json:"home,omitempty"`    // formerly link
+	Quant   float64   `json:"quant,omitempty"`
+	Price   float64   `json:"price,omitempty"`
+	PriceC  float64   `json:"price_cntr,omitempty"`
+	Parsed  *drugName `json:"parsed,omitempty"`
+	Link    linkDrug  `json:"link,omitempty"`
 }
 
 type itemV3Sale struct {
-	ID        string   `json:"id,omitempty"`
-	Name      string   `json:"name,omitempty"`
-	QuantIn   float64  `json:"quant_in,omitempty"`
-	PriceIn   float64  `json:"price_in,omitempty"`
-	QuantOut  float64  `json:"quant_out,omitempty"`
-	PriceOut  float64  `json:"price_out,omitempty"`
-	Stock     float64  `json:"stock,omitempty"`
-	Reimburse bool     `json:"reimburse,omitempty"`
-	SuppName  string   `json:"supp_name,omitempty"`
-	SuppCode  string   `json:"supp_code,omitempty"`
-	LinkAddr  linkAddr `json:"link_addr,omitempty"`
-	LinkDrug  linkDrug `json:"link_drug,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Barcode   string    `json:"barcode,omitempty"` // EAN-13/GTIN
+	QuantIn   float64   `json:"quant_in,omitempty"`
+	PriceIn   float64   `json:"price_in,omitempty"`
+	QuantOut  float64   `json:"quant_out,omitempty"`
+	PriceOut  float64   `json:"price_out,omitempty"`
+	Stock     float64   `json:"stock,omitempty"`
+	Reimburse bool      `json:"reimburse,omitempty"`
+	SuppName  string    `json:"supp_name,omitempty"`
+	SuppCode  string    `json:"supp_code,omitempty"`
+	Parsed    *drugName `json:"parsed,omitempty"`
+	LinkAddr  linkAddr  `json:"link_addr,omitempty"`
+	LinkDrug  linkDrug  `json:"link_drug,omitempty"`
 }
 
 type itemV3SaleBy struct {
-	ID       string   `json:"id,omitempty"`
-	Name     string   `json:"name,omitempty"`
-	QuantIn  float64  `json:"quant_in,omitempty"` // formerly QuantInp
-	PriceIn  float64  `json:"price_in,omitempty"` // formerly PriceInp
-	QuantOut float64  `json:"quant_out,omitempty"`
-	PriceOut float64  `json:"price_out,omitempty"`
-	PriceRoc float64  `json:"price_roc,omitempty"`
-	Stock    float64  `json:"stock,omitempty"`     // formerly Balance
-	StockTab float64  `json:"stock_tab,omitempty"` // formerly BalanceT
-	Link     linkDrug `json:"link,omitempty"`
+	ID       string    `json:"id,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Barcode  string    `json:"barcode,omitempty"`  // EAN-13/GTIN
+	QuantIn  float64   `json:"quant_in,omitempty"` // formerly QuantInp
+	PriceIn  float64   `json:"price_in,omitempty"` // formerly PriceInp
+	QuantOut float64   `json:"quant_out,omitempty"`
+	PriceOut float64   `json:"price_out,omitempty"`
+	PriceRoc float64   `json:"price_roc,omitempty"`
+	Stock    float64   `json:"stock,omitempty"`     // formerly Balance
+	StockTab float64   `json:"stock_tab,omitempty"` // formerly BalanceT
+	Parsed   *drugName `json:"parsed,omitempty"`
+	Link     linkDrug  `json:"link,omitempty"`
 }
 
 type ruler interface {
@@ -104,14 +165,19 @@ type ruler interface {
 
 type addrer interface {
 	ruler
+	getSuppCode(int) string
 	getSupp(int) string
+	normSupp(int) string
 	setAddr(int, linkAddr) bool
 }
 
 type druger interface {
 	ruler
+	getCode(int) string
 	getName(int) string
+	getBarcode(int) string
 	setDrug(int, linkDrug) bool
+	setParsed(int, drugName)
 }
 
 type jsonRcgnAddr []itemRcgnAddr
@@ -131,6 +197,22 @@ func (j jsonRcgnAddr) getSupp(i int) string {
 	return makeMagicName(j[i].Name, j[i].Addr)
 }
 
+// getSuppCode returns code for legal entities only (without address),
+// branches of one organization share the code
+func (j jsonRcgnAddr) getSuppCode(i int) string {
+	if j[i].Addr != "" {
+		return ""
+	}
+	return j[i].Code
+}
+
+// normSupp parses address and returns normalized magic string ("" if address has no street)
+func (j jsonRcgnAddr) normSupp(i int) string {
+	m, a := makeMagicNorm(j[i].Name, j[i].Head, j[i].Addr)
+	j[i].Parsed = &a
+	return m
+}
+
 func (j jsonRcgnAddr) setAddr(i int, l linkAddr) bool {
 	j[i].Link = l
 	return l.IDLink != 0
@@ -140,10 +222,23 @@ func (j jsonRcgnDrug) len() int {
 	return len(j)
 }
 
+// getCode returns "" because recognition must not teach crosswalk
+func (j jsonRcgnDrug) getCode(i int) string {
+	return ""
+}
+
 func (j jsonRcgnDrug) getName(i int) string {
 	return j[i].Name
 }
 
+func (j jsonRcgnDrug) getBarcode(i int) string {
+	return j[i].Barcode
+}
+
+func (j jsonRcgnDrug) setParsed(i int, d drugName) {
+	j[i].Parsed = &d
+}
+
 func (j jsonRcgnDrug) setDrug(i int, l linkDrug) bool {
 	j[i].Link = l
 	return l.IDLink != 0
@@ -153,10 +248,22 @@ func (j jsonV3Geoa) len() int {
 	return len(j)
 }
 
+func (j jsonV3Geoa) getCode(i int) string {
+	return j[i].ID
+}
+
 func (j jsonV3Geoa) getName(i int) string {
 	return j[i].Name
 }
 
+func (j jsonV3Geoa) getBarcode(i int) string {
+	return j[i].Barcode
+}
+
+func (j jsonV3Geoa) setParsed(i int, d drugName) {
+	j[i].Parsed = &d
+}
+
 func (j jsonV3Geoa) setDrug(i int, l linkDrug) bool {
 	j[i].Link = l
 	return l.IDLink != 0
@@ -166,19 +273,40 @@ func (j jsonV3Sale) len() int {
 	return len(j)
 }
 
+func (j jsonV3Sale) getCode(i int) string {
+	return j[i].ID
+}
+
 func (j jsonV3Sale) getName(i int) string {
 	return j[i].Name
 }
 
+func (j jsonV3Sale) getBarcode(i int) string {
+	return j[i].Barcode
+}
+
+func (j jsonV3Sale) setParsed(i int, d drugName) {
+	j[i].Parsed = &d
+}
+
 func (j jsonV3Sale) setDrug(i int, l linkDrug) bool {
 	j[i].LinkDrug = l
 	return l.IDLink != 0
 }
 
+func (j jsonV3Sale) getSuppCode(i int) string {
+	return j[i].SuppCode
+}
+
 func (j jsonV3Sale) getSupp(i int) string {
 	return j[i].SuppName
 }
 
+// normSupp returns "" because suppliers of sales have no address
+func (j jsonV3Sale) normSupp(i int) string {
+	return ""
+}
+
 func (j jsonV3Sale) setAddr(i int, l linkAddr) bool {
 	j[i].LinkAddr = l
 	return l.IDLink != 0
@@ -188,10 +316,22 @@ func (j jsonV3SaleBy) len() int {
 	return len(j)
 }
 
+func (j jsonV3SaleBy) getCode(i int) string {
+	return j[i].ID
+}
+
 func (j jsonV3SaleBy) getName(i int) string {
 	return j[i].Name
 }
 
+func (j jsonV3SaleBy) getBarcode(i int) string {
+	return j[i].Barcode
+}
+
+func (j jsonV3SaleBy) setParsed(i int, d drugName) {
+	j[i].Parsed = &d
+}
+
 func (j jsonV3SaleBy) setDrug(i int, l linkDrug) bool {
 	j[i].Link = l
 	return l.IDLink != 0
@@ -210,6 +350,7 @@ type jsonV1Sale struct {
 		Item []struct {
 			Code     string
 			Drug     string
+			Barcode  string  `json:",omitempty"`
 			Supp     string  `json:",omitempty"`
 			SuppOKPO string  `json:",omitempty"`
 			QuantInp float64 `json:",omitempty"`
@@ -235,6 +376,7 @@ type jsonV1SaleBy struct {
 		Item []struct {
 			Code     string
 			Drug     string
+			Barcode  string `json:",omitempty"`
 			QuantInp float64
 			QuantOut float64
 			PriceInp float64
@@ -259,6 +401,7 @@ type jsonV1Geoa struct {
 		ID       string  `json:"id,omitempty"`
 		Code     string  `json:"Code,omitempty"` // deprecated from 1.0
 		Name     string  `json:"name"`
+		Barcode  string  `json:"barcode,omitempty"`
 		Desc     string  `json:"Desc,omitempty"` // deprecated from 1.0
 		Addr     string  `json:"Addr,omitempty"` // deprecated from 1.0
 		Link     string  `json:"link"`
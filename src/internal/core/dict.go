@@ -0,0 +1,369 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"internal/database/redis"
+)
+
+const (
+	fldVers = "v"
+	fldName = "n"
+
+	// casN is number of attempts to write when watched keys are changed
+	casN = 8
+)
+
+// dictWrite describes a batch of changes in a dictionary.
+// Changes of the batch are applied atomically (WATCH/MULTI/EXEC).
+// Addr, drug and span entries carry a version counter (field "v") which is
+// incremented on each write and can be used for compare-and-set.
+type dictWrite struct {
+	dict  string
+	keys  []string
+	vals  []map[string]string // nil deletes keys
+	vers  []int64             // expected versions (0 skips check), nil skips all checks
+	merge bool                // merge vals into current values (PATCH) instead of replace (PUT)
+	cas   bool                // check zero versions too (key must not exist)
+	want  []map[string]string // expected current values (nil skips check), see Undo
+}
+
+func nameHash(name string) map[string]string {
+	h := make(map[string]string, 1)
+	putStr(h, fldName, name)
+	return h
+}
+
+// testNames rejects empty names of dictionaries inside one hash on set
+// (an empty name would delete the entry, entries are deleted by del only)
+func testNames(w *dictWrite) error {
+	for i := range w.keys {
+		if w.vals[i][fldName] == "" {
+			return fmt.Errorf("core: empty name of %s %s", w.dict, w.keys[i])
+		}
+	}
+	return nil
+}
+
+// dictKey returns redis key and field (for dictionaries inside one hash)
+func dictKey(dict, key string) (string, string, error) {
+	switch dict {
+	case dictAuth:
+		return keyAuth(), key, nil
+	case dictStat:
+		return keyStat(), key, nil
+	case dictAddr:
+		return keyAddr(key), "", nil
+	case dictDrug:
+		return keyDrug(key), "", nil
+	case dictBarc:
+		return keyBarc(key), "", nil
+	case dictXwlk:
+		auth, code, err := splitXwlkKey(key)
+		return keyXwlk(auth), code, err
+	case dictRich:
+		return keyRich(), key, nil
+	case dictStatEffect:
+		return keyStatEffect(), key, nil
+	case dictAuthStat:
+		return keyAuthStat(), key, nil
+	case dictSpanDrug, dictSpanAddr:
+		return keySpan(dict, key), "", nil
+	case dictRetn:
+		return keyRetn(), key, nil
+	}
+	if isNameDict(dict) {
+		return keyName(dict), key, nil
+	}
+	return "", "", fmt.Errorf("core: invalid dict %s", dict)
+}
+
+func readDict(dict string, keys []string) ([]map[string]string, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	return readDictConn(c, dict, keys)
+}
+
+func readDictConn(c redis.Connection, dict string, keys []string) ([]map[string]string, error) {
+	var (
+		k, f string
+		err  error
+	)
+	for i := range keys {
+		k, f, err = dictKey(dict, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if f != "" {
+			err = c.Send("HGET", k, f)
+		} else {
+			err = c.Send("HGETALL", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]map[string]string, len(keys))
+	var n string
+	for i := range keys {
+		_, f, _ = dictKey(dict, keys[i])
+		if f == "" {
+			out[i], err = redis.StringMap(c.Receive())
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n, err = redis.String(c.Receive())
+		if err != nil && redis.NotErrNil(err) {
+			return nil, err
+		}
+		out[i] = nameHash(n)
+	}
+
+	return out, nil
+}
+
+// writeDict applies changes and appends audit records atomically
+func writeDict(w *dictWrite, a actor) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	watch := make([]interface{}, 0, len(w.keys))
+	uniq := make(map[string]struct{}, len(w.keys))
+	for i := range w.keys {
+		k, _, err := dictKey(w.dict, w.keys[i])
+		if err != nil {
+			return err
+		}
+		if _, ok := uniq[k]; !ok {
+			uniq[k] = struct{}{}
+			watch = append(watch, k)
+		}
+	}
+	if w.dict == dictAddr {
+		watch = append(watch, keyEgrp()) // index entries are read by readCodeAddr
+	}
+
+	for n := 0; n < casN; n++ {
+		old, ok, err := execDict(c, w, watch, a)
+		if err != nil {
+			return err
+		}
+		if ok {
+			dropCache(w.dict, w.keys)
+			_, err = dropFuzz(w.dict, unlinkedFuzz(w, old))
+			if err != nil {
+				log.Println(err)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("core: too many concurrent writes, try again")
+}
+
+// execDict returns false if watched keys were changed by somebody else
+func execDict(c redis.Connection, w *dictWrite, watch []interface{}, a actor) ([]map[string]string, bool, error) {
+	_, err := c.Do("WATCH", watch...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	old, err := readDictConn(c, w.dict, w.keys)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = testVers(w, old)
+	if err == nil {
+		err = testMerge(w, old)
+	}
+	if err != nil {
+		_, _ = c.Do("UNWATCH")
+		return nil, false, err
+	}
+
+	own, err := readCodeAddr(c, w, old)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = c.Send("MULTI")
+	if err != nil {
+		return nil, false, err
+	}
+
+	var val map[string]string
+	for i := range w.keys {
+		val = nextDict(w, i, old[i])
+		err = sendDict(c.Send, w.dict, w.keys[i], val)
+		if err != nil {
+			return nil, false, err
+		}
+		if w.dict != dictAddr {
+			continue
+		}
+		err = sendCodeAddr(c.Send, w.keys[i], own[i], old[i], val)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = sendAudit(c.Send, makeAudit(w, old), a)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r, err := c.Do("EXEC")
+	if err != nil {
+		return nil, false, err
+	}
+
+	return old, r != nil, nil
+}
+
+// nextDict returns new value of i-th key (nil if key must be deleted)
+func nextDict(w *dictWrite, i int, old map[string]string) map[string]string {
+	if w.vals == nil || len(w.vals[i]) == 0 && !w.merge {
+		return nil
+	}
+
+	val := make(map[string]string, len(w.vals[i])+len(old)+1)
+	if w.merge {
+		for k, v := range old {
+			val[k] = v
+		}
+	}
+	for k, v := range w.vals[i] {
+		val[k] = v
+	}
+
+	if _, f, _ := dictKey(w.dict, w.keys[i]); f == "" {
+		v, _ := strconv.ParseInt(old[fldVers], 10, 64)
+		val[fldVers] = strconv.FormatInt(v+1, 10)
+	}
+
+	return val
+}
+
+func testVers(w *dictWrite, old []map[string]string) error {
+	var fail []string
+	for i := range w.keys {
+		if w.want != nil && !sameDict(w.want[i], old[i]) {
+			fail = append(fail, fmt.Sprintf("%s (changed since)", w.keys[i]))
+			continue
+		}
+		if w.vers == nil || w.vers[i] == 0 && !w.cas {
+			continue
+		}
+		v, _ := strconv.ParseInt(old[i][fldVers], 10, 64)
+		if v != w.vers[i] {
+			fail = append(fail, fmt.Sprintf("%s (%d != %d)", w.keys[i], w.vers[i], v))
+		}
+	}
+
+	if len(fail) > 0 {
+		return errVers(fail)
+	}
+
+	return nil
+}
+
+// testMerge rejects merge (PATCH) into keys which do not exist
+func testMerge(w *dictWrite, old []map[string]string) error {
+	if !w.merge {
+		return nil
+	}
+
+	var miss []string
+	for i := range w.keys {
+		if len(old[i]) == 0 {
+			miss = append(miss, w.keys[i])
+		}
+	}
+
+	if len(miss) > 0 {
+		return fmt.Errorf("core: not found: %s", strings.Join(miss, ", "))
+	}
+
+	return nil
+}
+
+// sameDict returns true if values are equal except versions (a value
+// restored by undo has a new version), missing and empty are the same
+func sameDict(a, b map[string]string) bool {
+	n := 0
+	for k, v := range a {
+		if k == fldVers {
+			continue
+		}
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+		n++
+	}
+	for k := range b {
+		if k != fldVers {
+			n--
+		}
+	}
+	return n == 0
+}
+
+// errVers lists keys whose versions differ from expected ones
+type errVers []string
+
+func (e errVers) Error() string {
+	return fmt.Sprintf("core: version conflict: %s", strings.Join(e, ", "))
+}
+
+func sendDict(send func(string, ...interface{}) error, dict, key string, val map[string]string) error {
+	k, f, err := dictKey(dict, key)
+	if err != nil {
+		return err
+	}
+
+	if f != "" {
+		if val[fldName] == "" {
+			return send("HDEL", k, f)
+		}
+		return send("HSET", k, f, val[fldName])
+	}
+
+	err = send("DEL", k)
+	if err != nil || len(val) == 0 {
+		return err
+	}
+
+	vls := make([]interface{}, 0, len(val)*2+1)
+	vls = append(vls, k)
+	for f, v := range val {
+		vls = append(vls, f, v)
+	}
+
+	return send("HMSET", vls...)
+}
+
+func makeAudit(w *dictWrite, old []map[string]string) []auditItem {
+	v := make([]auditItem, len(w.keys))
+	for i := range w.keys {
+		v[i] = auditItem{
+			Dict: w.dict,
+			Key:  w.keys[i],
+			Old:  old[i],
+			New:  nextDict(w, i, old[i]),
+		}
+	}
+	return v
+}
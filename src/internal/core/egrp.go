@@ -0,0 +1,298 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:egrp"
+// HSET key EGRPOU->ID (SHA1 of addr link)
+const (
+	fldCode = "e"
+)
+
+type linkCode struct {
+	Code string `json:"code,omitempty"`
+	Norm string `json:"norm,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+func keyEgrp() string {
+	return makeKey(nsHset, "egrp")
+}
+
+// normEGRPOU returns valid EGRPOU (8 digits, leading zeros restored)
+// or RNOKPP (10 digits) code, or "" if code is invalid
+func normEGRPOU(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+
+	switch {
+	case len(s) >= 5 && len(s) <= 8:
+		s = strings.Repeat("0", 8-len(s)) + s
+		if testEGRPOU(s) {
+			return s
+		}
+	case len(s) == 10:
+		if testRNOKPP(s) {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// testEGRPOU checks control digit of 8 digits code
+func testEGRPOU(s string) bool {
+	w := []int{1, 2, 3, 4, 5, 6, 7}
+	if s >= "30000000" && s <= "60000000" {
+		w = []int{7, 1, 2, 3, 4, 5, 6}
+	}
+
+	r := sumDigits(s, w, 0) % 11
+	if r == 10 {
+		r = sumDigits(s, w, 2) % 11
+		if r == 10 {
+			r = 0
+		}
+	}
+
+	return r == int(s[7]-'0')
+}
+
+// testRNOKPP checks control digit of 10 digits code
+func testRNOKPP(s string) bool {
+	w := []int{-1, 5, 7, 9, 4, 6, 10, 5, 7}
+	r := sumDigits(s, w, 0) % 11
+	if r < 0 {
+		r += 11
+	}
+	return r%10 == int(s[9]-'0')
+}
+
+func sumDigits(s string, w []int, add int) int {
+	n := 0
+	for i := range w {
+		n += int(s[i]-'0') * (w[i] + add)
+	}
+	return n
+}
+
+// getCodeAddr returns addr keys by codes ("" if code is invalid or unknown)
+func getCodeAddr(v []string) ([]string, error) {
+	out := make([]string, len(v))
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	n := 0
+	var err error
+	for i := range v {
+		out[i] = normEGRPOU(v[i])
+		if out[i] == "" {
+			continue
+		}
+		err = c.Send("HGET", keyEgrp(), out[i])
+		if err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	if n == 0 {
+		return out, nil
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range v {
+		if out[i] == "" {
+			continue
+		}
+		out[i], err = redis.String(c.Receive())
+		if err != nil && redis.NotErrNil(err) {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// readCodeAddr returns current owners of index entries for old codes of addr keys
+func readCodeAddr(c redis.Connection, w *dictWrite, old []map[string]string) ([]string, error) {
+	out := make([]string, len(w.keys))
+	if w.dict != dictAddr {
+		return out, nil
+	}
+
+	var (
+		code string
+		err  error
+	)
+	for i := range w.keys {
+		code = normEGRPOU(old[i][fldCode])
+		if code == "" {
+			continue
+		}
+		out[i], err = redis.String(c.Do("HGET", keyEgrp(), code))
+		if err != nil && redis.NotErrNil(err) {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// sendCodeAddr updates index entry when code of addr key is changed
+func sendCodeAddr(send func(string, ...interface{}) error, key, owner string, old, val map[string]string) error {
+	o, n := normEGRPOU(old[fldCode]), normEGRPOU(val[fldCode])
+	if o != "" && o != n && owner == key {
+		err := send("HDEL", keyEgrp(), o)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n != "" {
+		return send("HSET", keyEgrp(), n, key)
+	}
+
+	return nil
+}
+
+// GetEgrp returns addr keys by EGRPOU codes.
+// JSON array: ["code1","code2"]
+func GetEgrp(data []byte) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := getCodeAddr(v)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]linkCode, len(v))
+	for i := range v {
+		out[i] = linkCode{Code: v[i], Norm: normEGRPOU(v[i]), ID: ids[i]}
+	}
+
+	return out, nil
+}
+
+// Reindex rebuilds EGRPOU index from addr links: index is built in a
+// temporary key which replaces it if it is not changed meanwhile (stale
+// entries of changed or deleted codes are dropped).
+func Reindex(data []byte) (interface{}, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	tmp := makeKey(nsHset, "egrp", strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _, _ = c.Do("DEL", tmp) }()
+
+	for n := 0; n < casN; n++ {
+		_, err := c.Do("WATCH", keyEgrp())
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := buildEgrp(tmp)
+		if err != nil {
+			_, _ = c.Do("UNWATCH")
+			return nil, err
+		}
+
+		err = c.Send("MULTI")
+		if err != nil {
+			return nil, err
+		}
+		if m != 0 {
+			err = c.Send("RENAME", tmp, keyEgrp())
+		} else {
+			err = c.Send("DEL", keyEgrp())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := c.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return m, nil
+		}
+	}
+
+	return nil, fmt.Errorf("core: too many concurrent writes, try again")
+}
+
+// buildEgrp puts codes of addr links into new hash and returns their number
+func buildEgrp(key string) (int, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	_, err := c.Do("DEL", key)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = scanKeys(migrScan, keyAddr("*"), func(keys []string) error {
+		var err error
+		for i := range keys {
+			err = c.Send("HGET", keys[i], fldCode)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = c.Flush()
+		if err != nil {
+			return err
+		}
+
+		code := make([]string, len(keys))
+		for i := range keys {
+			code[i], err = redis.String(c.Receive())
+			if err != nil && redis.NotErrNil(err) {
+				return err
+			}
+		}
+
+		for i := range keys {
+			code[i] = normEGRPOU(code[i])
+			if code[i] == "" {
+				continue
+			}
+			err = c.Send("HSET", key, code[i], strings.TrimPrefix(keys[i], keyAddr("")))
+			if err != nil {
+				return err
+			}
+			n++
+		}
+
+		_, err = c.Do("")
+		return err
+	})
+
+	return n, err
+}
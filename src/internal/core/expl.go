@@ -0,0 +1,610 @@
+package core
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:mags:<dict>"
+// HSET key ID->magic (magic strings of keys linked by name)
+// SET => key="<prefix>:fuzz:<dict>:<token>"
+// SADD key ID [ID...] (keys whose names contain token, see fuzzTokens)
+// Catalogue of known names for fuzzy candidates of /recognize: BuildFuzz
+// (command "fuzz") learns linked keys from archive, dictionary writes remove
+// keys which are deleted or left without link (uploads do not write it).
+const (
+	matchFuzz = "fuzzy"
+
+	nsFuzz = "fuzz"
+
+	fuzzMin    = 0.9 // min score to link by fuzzy candidate (on demand)
+	fuzzN      = 3   // max number of runner-ups
+	fuzzToks   = 2   // number of rarest tokens to look candidates by
+	fuzzSample = 100 // max number of candidates per token
+)
+
+// matchScore is confidence of lookup methods (fuzzy uses similarity)
+var matchScore = map[string]float64{
+	matchName: 1,
+	matchCode: 1,
+	matchBarc: 1,
+	matchXwlk: 0.95,
+	matchNorm: 0.9,
+}
+
+// linkExpl explains why row is linked (or not)
+type linkExpl struct {
+	Magic  string     `json:"magic"`          // magic string
+	Norm   string     `json:"norm,omitempty"` // magic string of normalized notation
+	Key    string     `json:"key"`            // SHA1 of magic string
+	Method string     `json:"method,omitempty"`
+	Score  float64    `json:"score"`
+	Cands  []linkCand `json:"cands,omitempty"` // runner-ups
+}
+
+type linkCand struct {
+	Key    string  `json:"key"`
+	Magic  string  `json:"magic"`
+	Score  float64 `json:"score"`
+	IDLink int64   `json:"id_link,omitempty"`
+}
+
+func keyMags(dict string) string {
+	return makeKey(nsHset, "mags", dict)
+}
+
+func keyFuzz(dict, tok string) string {
+	return makeKey(nsFuzz, dict, tok)
+}
+
+// fuzzTokens returns folded words of name which are long enough to look by
+func fuzzTokens(name string) []string {
+	t := tokenizeName(name)
+	out := t[:0]
+	for i := range t {
+		if utf8.RuneCountInString(t[i]) < 3 || isNumber(t[i]) {
+			continue
+		}
+		out = append(out, phonWord(t[i]))
+	}
+	return out
+}
+
+// putFuzz remembers magic strings and tokens of keys linked by name,
+// returns number of new keys (known keys are not written again)
+func putFuzz(dict string, keys, magics []string) (int, error) {
+	uniq, idx := uniqKeys(keys)
+	mags := make([]string, len(uniq))
+	for i := range keys {
+		mags[idx[i]] = magics[i]
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	n := 0
+	vls := make([]interface{}, 0, lookChunk+1)
+	for p := 0; p < len(uniq); p += lookChunk {
+		q := lookEnd(p, len(uniq))
+
+		vls = append(vls[:0], keyMags(dict))
+		for i := p; i < q; i++ {
+			vls = append(vls, uniq[i])
+		}
+
+		r, err := redis.Strings(c.Do("HMGET", vls...))
+		if err != nil {
+			return n, err
+		}
+
+		for i := p; i < q; i++ {
+			if r[i-p] != "" {
+				continue // already known
+			}
+			err = c.Send("HSETNX", keyMags(dict), uniq[i], mags[i])
+			if err != nil {
+				return n, err
+			}
+			for _, t := range fuzzTokens(fuzzName(mags[i])) {
+				err = c.Send("SADD", keyFuzz(dict, t), uniq[i])
+				if err != nil {
+					return n, err
+				}
+			}
+			n++
+		}
+
+		_, err = c.Do("")
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// dropFuzz removes keys and their tokens from fuzzy catalogue,
+// returns number of removed keys
+func dropFuzz(dict string, keys []string) (int, error) {
+	if !isFuzzDict(dict) || len(keys) == 0 {
+		return 0, nil
+	}
+
+	uniq, _ := uniqKeys(keys)
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	n := 0
+	vls := make([]interface{}, 0, lookChunk+1)
+	for p := 0; p < len(uniq); p += lookChunk {
+		q := lookEnd(p, len(uniq))
+
+		vls = append(vls[:0], keyMags(dict))
+		for i := p; i < q; i++ {
+			vls = append(vls, uniq[i])
+		}
+
+		r, err := redis.Strings(c.Do("HMGET", vls...))
+		if err != nil {
+			return n, err
+		}
+
+		for i := p; i < q; i++ {
+			if r[i-p] == "" {
+				continue // not known
+			}
+			for _, t := range fuzzTokens(fuzzName(r[i-p])) {
+				err = c.Send("SREM", keyFuzz(dict, t), uniq[i])
+				if err != nil {
+					return n, err
+				}
+			}
+			err = c.Send("HDEL", keyMags(dict), uniq[i])
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		_, err = c.Do("")
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// unlinkedFuzz returns keys of write which are deleted or left without link
+// (they are not linked by name any more)
+func unlinkedFuzz(w *dictWrite, old []map[string]string) []string {
+	if !isFuzzDict(w.dict) {
+		return nil
+	}
+
+	var out []string
+	for i := range w.keys {
+		v := nextDict(w, i, old[i])
+		if l, _ := strconv.ParseInt(v["l"], 10, 64); l == 0 {
+			out = append(out, w.keys[i])
+		}
+	}
+	return out
+}
+
+func isFuzzDict(dict string) bool {
+	return dict == dictDrug || dict == dictAddr
+}
+
+// fuzzName returns name of magic string (without country suffix)
+func fuzzName(magic string) string {
+	n, _ := splitMagicSuffix(magic)
+	return n
+}
+
+// findFuzz returns candidates (sorted by score) of rows, links are not filled
+func findFuzz(dict string, names, magics []string) ([][]linkCand, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	// 1. size of token sets
+	toks := make([][]string, len(names))
+	var err error
+	for i := range names {
+		toks[i] = fuzzTokens(names[i])
+		for _, t := range toks[i] {
+			err = c.Send("SCARD", keyFuzz(dict, t))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range toks {
+		size := make(map[string]int64, len(toks[i]))
+		for _, t := range toks[i] {
+			size[t], err = redis.Int64(c.Receive())
+			if err != nil {
+				return nil, err
+			}
+		}
+		toks[i] = rareTokens(toks[i], size)
+	}
+
+	// 2. sample of keys of the rarest tokens
+	for i := range toks {
+		for _, t := range toks[i] {
+			err = c.Send("SRANDMEMBER", keyFuzz(dict, t), fuzzSample)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]string, len(names))
+	for i := range toks {
+		uniq := make(map[string]struct{})
+		for range toks[i] {
+			r, err := redis.Strings(c.Receive())
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range r {
+				if _, ok := uniq[k]; !ok {
+					uniq[k] = struct{}{}
+					keys[i] = append(keys[i], k)
+				}
+			}
+		}
+	}
+
+	// 3. magic strings of candidates
+	for i := range keys {
+		if len(keys[i]) == 0 {
+			continue
+		}
+		vls := make([]interface{}, 0, len(keys[i])+1)
+		vls = append(vls, keyMags(dict))
+		for _, k := range keys[i] {
+			vls = append(vls, k)
+		}
+		err = c.Send("HMGET", vls...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]linkCand, len(names))
+	for i := range keys {
+		if len(keys[i]) == 0 {
+			continue
+		}
+		r, err := redis.Strings(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for j := range r {
+			if r[j] == "" || r[j] == magics[i] {
+				continue
+			}
+			out[i] = append(out[i], linkCand{Key: keys[i][j], Magic: r[j], Score: simMagic(magics[i], r[j])})
+		}
+		sort.Stable(candsByScore(out[i]))
+		if len(out[i]) > fuzzN+1 {
+			out[i] = out[i][:fuzzN+1]
+		}
+	}
+
+	return out, nil
+}
+
+// rareTokens returns up to fuzzToks tokens with the smallest non-empty sets
+func rareTokens(t []string, size map[string]int64) []string {
+	out := make([]string, 0, len(t))
+	for i := range t {
+		if size[t[i]] > 0 {
+			out = append(out, t[i])
+		}
+	}
+	sort.Stable(toksBySize{out, size})
+	if len(out) > fuzzToks {
+		out = out[:fuzzToks]
+	}
+	return out
+}
+
+type candsByScore []linkCand
+
+func (v candsByScore) Len() int           { return len(v) }
+func (v candsByScore) Less(i, j int) bool { return v[i].Score > v[j].Score }
+func (v candsByScore) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+type toksBySize struct {
+	t    []string
+	size map[string]int64
+}
+
+func (v toksBySize) Len() int           { return len(v.t) }
+func (v toksBySize) Less(i, j int) bool { return v.size[v.t[i]] < v.size[v.t[j]] }
+func (v toksBySize) Swap(i, j int)      { v.t[i], v.t[j] = v.t[j], v.t[i] }
+
+// simMagic returns similarity (0..1) of magic strings, as is and with
+// UA/RU spelling differences folded: "Аспирин" ~ "Аспірин" = 0.93
+func simMagic(a, b string) float64 {
+	return (simText(strings.ToLower(a), strings.ToLower(b)) + simText(foldText(a), foldText(b))) / 2
+}
+
+func foldText(s string) string {
+	t := tokenizeName(s)
+	for i := range t {
+		t[i] = phonWord(t[i])
+	}
+	return strings.Join(t, " ")
+}
+
+// simText returns 1 - Levenshtein distance / max length (in runes)
+func simText(a, b string) float64 {
+	r1, r2 := []rune(a), []rune(b)
+	n := len(r1)
+	if len(r2) > n {
+		n = len(r2)
+	}
+	if n == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(r2)+1)
+	curr := make([]int, len(r2)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(r1); i++ {
+		curr[0] = i
+		for j := 1; j <= len(r2); j++ {
+			d := prev[j-1]
+			if r1[i-1] != r2[j-1] {
+				d++
+			}
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if curr[j-1]+1 < d {
+				d = curr[j-1] + 1
+			}
+			curr[j] = d
+		}
+		prev, curr = curr, prev
+	}
+
+	return 1 - float64(prev[len(r2)])/float64(n)
+}
+
+// mineRcgn links rows of /recognize and recognize jobs: the same as stream,
+// plus explanations and links by fuzzy candidates on demand
+func mineRcgn(v interface{}, m *meta) (interface{}, error) {
+	d, err := mineLinks(v, m)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := getEffects()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case jsonRcgnDrug:
+		err = explainDrugs(v, filepath.Ext(m.HTag), m.Expl, m.Fuzz, e)
+	case jsonRcgnAddr:
+		err = explainAddrs(v, m.Expl, m.Fuzz, e)
+	}
+
+	for k, n := range e.count {
+		if m.Stat == nil {
+			m.Stat = make(map[string]int64)
+		}
+		m.Stat[k] += n
+	}
+
+	return d, err
+}
+
+func explainDrugs(v jsonRcgnDrug, ext string, expl, fuzz bool, e *statEffects) error {
+	rows := fuzzRows(len(v), expl, fuzz, func(i int) bool { return v[i].Link.IDLink == 0 })
+	if len(rows) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(rows))
+	magics := make([]string, len(rows))
+	for j, i := range rows {
+		names[j] = v[i].Name
+		magics[j] = makeMagicDrugExt(v[i].Name, ext)
+	}
+
+	cands, err := findFuzz(dictDrug, names, magics)
+	if err != nil {
+		return err
+	}
+
+	var look []string
+	for j := range cands {
+		for _, c := range cands[j] {
+			look = append(look, c.Key)
+		}
+	}
+
+	lds, err := getLinkDrugCache(look)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for j, i := range rows {
+		l := make(map[string]linkDrug, len(cands[j]))
+		for k := range cands[j] {
+			cands[j][k].IDLink = lds[n].IDLink
+			l[cands[j][k].Key] = lds[n]
+			n++
+		}
+
+		cands[j] = linkedCands(cands[j])
+		if fuzz && v[i].Link.IDLink == 0 && v[i].Link.IDStat == 0 && len(cands[j]) > 0 && cands[j][0].Score >= fuzzMin &&
+			sameNotation(magics[j], cands[j][0].Magic) {
+			v[i].Link = l[cands[j][0].Key]
+			v[i].Link.Match = matchFuzz
+			v[i].Link = e.blockDrug(v[i].Link, strToSHA1(magics[j]))
+		}
+
+		if !expl {
+			continue
+		}
+
+		x := &linkExpl{
+			Magic:  magics[j],
+			Key:    strToSHA1(magics[j]),
+			Method: v[i].Link.Match,
+			Score:  matchScore[v[i].Link.Match],
+			Cands:  runnerUps(cands[j], v[i].Link.ID),
+		}
+		if v[i].Parsed != nil && v[i].Parsed.canon() != "" {
+			x.Norm = makeMagicDrugExt(v[i].Parsed.canon(), ext)
+		}
+		if x.Method == matchFuzz {
+			x.Score = cands[j][0].Score
+		}
+		v[i].Expl = x
+	}
+
+	return nil
+}
+
+func explainAddrs(v jsonRcgnAddr, expl, fuzz bool, e *statEffects) error {
+	rows := fuzzRows(len(v), expl, fuzz, func(i int) bool { return v[i].Link.IDLink == 0 })
+	if len(rows) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(rows))
+	magics := make([]string, len(rows))
+	for j, i := range rows {
+		names[j] = v.getSupp(i)
+		magics[j] = makeMagicAddr(names[j])
+	}
+
+	cands, err := findFuzz(dictAddr, names, magics)
+	if err != nil {
+		return err
+	}
+
+	var look []string
+	for j := range cands {
+		for _, c := range cands[j] {
+			look = append(look, c.Key)
+		}
+	}
+
+	lds, err := getLinkAddrCache(look)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for j, i := range rows {
+		l := make(map[string]linkAddr, len(cands[j]))
+		for k := range cands[j] {
+			cands[j][k].IDLink = lds[n].IDLink
+			l[cands[j][k].Key] = lds[n]
+			n++
+		}
+
+		cands[j] = linkedCands(cands[j])
+		if fuzz && v[i].Link.IDLink == 0 && v[i].Link.IDStat == 0 && len(cands[j]) > 0 && cands[j][0].Score >= fuzzMin {
+			v[i].Link = l[cands[j][0].Key]
+			v[i].Link.Match = matchFuzz
+			v[i].Link = e.blockAddr(v[i].Link, strToSHA1(magics[j]))
+		}
+
+		if !expl {
+			continue
+		}
+
+		x := &linkExpl{
+			Magic:  magics[j],
+			Key:    strToSHA1(magics[j]),
+			Method: v[i].Link.Match,
+			Score:  matchScore[v[i].Link.Match],
+			Cands:  runnerUps(cands[j], v[i].Link.ID),
+		}
+		x.Norm, _ = makeMagicNorm(v[i].Name, v[i].Head, v[i].Addr)
+		if x.Method == matchFuzz {
+			x.Score = cands[j][0].Score
+		}
+		v[i].Expl = x
+	}
+
+	return nil
+}
+
+// fuzzRows returns rows to look fuzzy candidates for: all rows to explain
+// or not linked rows to link by candidates
+func fuzzRows(n int, expl, fuzz bool, unlinked func(int) bool) []int {
+	var out []int
+	for i := 0; i < n; i++ {
+		if expl || fuzz && unlinked(i) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// sameNotation returns false if drug names differ in form, strength or pack
+// (similar names of different packs are not the same product)
+func sameNotation(a, b string) bool {
+	p, q := parseDrugName(a), parseDrugName(b)
+	return p.Form == q.Form && p.Dose == q.Dose && p.Unit == q.Unit && p.Pack == q.Pack
+}
+
+// linkedCands drops candidates which are not linked
+func linkedCands(v []linkCand) []linkCand {
+	out := v[:0]
+	for i := range v {
+		if v[i].IDLink != 0 {
+			out = append(out, v[i])
+		}
+	}
+	return out
+}
+
+// runnerUps returns candidates except chosen one
+func runnerUps(v []linkCand, key string) []linkCand {
+	out := make([]linkCand, 0, len(v))
+	for i := range v {
+		if v[i].Key != key && len(out) < fuzzN {
+			out = append(out, v[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"internal/database/minio"
+)
+
+// fuzzStat is report of BuildFuzz
+type fuzzStat struct {
+	Time    string           `json:"time"`
+	Proc    string           `json:"proc"`
+	Objects int64            `json:"objects"`
+	Fail    int64            `json:"fail"`
+	Keys    map[string]int64 `json:"keys"`    // catalogued keys checked by prune
+	Added   map[string]int64 `json:"added"`   // keys learned from archive
+	Removed map[string]int64 `json:"removed"` // keys which are not linked any more
+}
+
+// BuildFuzz backfills fuzzy catalogue by names of archived uploads which
+// are linked by name and removes catalogued keys which are not linked.
+// JSON object: {"prune":true} (prune only, archive is not read)
+func BuildFuzz(data []byte) (interface{}, error) {
+	o := struct {
+		Prune bool `json:"prune"`
+	}{}
+	if len(data) > 0 {
+		err := json.Unmarshal(data, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := time.Now()
+	s := &fuzzStat{
+		Time:    t.UTC().Format(time.RFC3339),
+		Keys:    make(map[string]int64),
+		Added:   make(map[string]int64),
+		Removed: make(map[string]int64),
+	}
+
+	if !o.Prune {
+		err := minio.Walk(bucketArchive, "", func(name string) bool {
+			s.Objects++
+			err := learnArch(name, s)
+			if err != nil {
+				s.Fail++
+				log.Println("core: fuzz", name, err)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range []string{dictDrug, dictAddr} {
+		err := pruneFuzz(d, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.Proc = time.Since(t).String()
+	return s, nil
+}
+
+// learnArch learns names of archived upload which are linked by name
+func learnArch(name string, s *fuzzStat) error {
+	f, err := minio.Get(bucketArchive, name)
+	if err != nil {
+		return err
+	}
+	defer minio.Free(f)
+
+	meta, data, err := unpackMetaData(f)
+	if err != nil {
+		return err
+	}
+
+	m, err := unmarshalMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	v, err := unmarshalData(data, m)
+	if err != nil {
+		return err
+	}
+
+	if d, ok := v.(druger); ok {
+		ext := filepath.Ext(m.HTag)
+		mags := make([]string, d.len())
+		for i := range mags {
+			mags[i] = makeMagicDrugExt(d.getName(i), ext)
+		}
+		err = learnLinked(dictDrug, mags, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a, ok := v.(addrer); ok && (isSaleIn(m.HTag) || isRcgnAddr(m.HTag)) {
+		mags := make([]string, a.len())
+		for i := range mags {
+			mags[i] = makeMagicAddr(a.getSupp(i))
+		}
+		err = learnLinked(dictAddr, mags, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// learnLinked puts magic strings whose keys are linked to fuzzy catalogue
+func learnLinked(dict string, mags []string, s *fuzzStat) error {
+	keys := make([]string, len(mags))
+	for i := range mags {
+		keys[i] = strToSHA1(mags[i])
+	}
+
+	uniq, idx := uniqKeys(keys)
+	ids, err := getFuzzLinks(dict, uniq)
+	if err != nil {
+		return err
+	}
+
+	var k, m []string
+	for i := range keys {
+		if ids[idx[i]] != 0 {
+			k = append(k, keys[i])
+			m = append(m, mags[i])
+		}
+	}
+
+	n, err := putFuzz(dict, k, m)
+	s.Added[dict] += int64(n)
+	return err
+}
+
+// pruneFuzz removes catalogued keys of dict which are not linked
+func pruneFuzz(dict string, s *fuzzStat) error {
+	var keys []string
+	err := scanHash(migrScan, keyMags(dict), func(kv []string) error {
+		for i := 0; i+1 < len(kv); i += 2 {
+			keys = append(keys, kv[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Keys[dict] += int64(len(keys))
+
+	ids, err := getFuzzLinks(dict, keys)
+	if err != nil {
+		return err
+	}
+
+	var drop []string
+	for i := range keys {
+		if ids[i] == 0 {
+			drop = append(drop, keys[i])
+		}
+	}
+
+	n, err := dropFuzz(dict, drop)
+	s.Removed[dict] += int64(n)
+	return err
+}
+
+// getFuzzLinks returns link IDs of keys of dict (0 if not linked)
+func getFuzzLinks(dict string, keys []string) ([]int64, error) {
+	out := make([]int64, len(keys))
+	switch dict {
+	case dictDrug:
+		l, err := getLinkDrug(keys)
+		if err != nil {
+			return nil, err
+		}
+		for i := range l {
+			out[i] = l[i].IDLink
+		}
+	case dictAddr:
+		l, err := getLinkAddr(keys)
+		if err != nil {
+			return nil, err
+		}
+		for i := range l {
+			out[i] = l[i].IDLink
+		}
+	default:
+		return nil, fmt.Errorf("core: invalid dict %s", dict)
+	}
+	return out, nil
+}
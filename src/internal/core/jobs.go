@@ -0,0 +1,377 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"internal/database/minio"
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:jobs:<uuid>" (expires after jobTTL)
+// HMSET key h/htag s/stat r/rows d/done f/fail t/time p/proc o/object
+// Async recognize jobs: payload is stored in bucket rcgn-in, processed by
+// procJob (like stream-in) in chunks, result is stored in bucket rcgn-out
+// (removed by retention after jobTTL unless rule is set). Worker holds lock
+// "<prefix>:lock:job:<object>" while it processes payload.
+const (
+	bucketRcgnIn  = "rcgn-in"
+	bucketRcgnOut = "rcgn-out"
+
+	subjectRcgnIn = "m12." + bucketRcgnIn
+
+	nsJobs = "jobs"
+
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	jobChunk   = 5000
+	jobTTL     = 60 * 60 * 24 * 7
+	jobLockTTL = time.Minute
+)
+
+type jobStat struct {
+	ID   string `json:"id"`
+	HTag string `json:"htag,omitempty"`
+	Stat string `json:"stat"`
+	Rows int64  `json:"rows,omitempty"`
+	Done int64  `json:"done,omitempty"`
+	Fail string `json:"fail,omitempty"`
+	Time string `json:"time,omitempty"`
+	Proc string `json:"proc,omitempty"`
+}
+
+type jobQuery struct {
+	ID     string `json:"id"`
+	Format string `json:"format,omitempty"` // json (default) or csv
+}
+
+func keyJob(id string) string {
+	return makeKey(nsJobs, id)
+}
+
+func isRcgn(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "rcgn.")
+}
+
+func setJob(id string, f ...interface{}) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	err := c.Send("HMSET", append([]interface{}{keyJob(id)}, f...)...)
+	if err != nil {
+		return err
+	}
+
+	err = c.Send("EXPIRE", keyJob(id), jobTTL)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("")
+	return err
+}
+
+func getJob(id string) (jobStat, string, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	h, err := redis.StringMap(c.Do("HGETALL", keyJob(id)))
+	if err != nil {
+		return jobStat{}, "", err
+	}
+
+	if len(h) == 0 {
+		return jobStat{}, "", fmt.Errorf("core: job %s not found", id)
+	}
+
+	s := jobStat{
+		ID:   id,
+		HTag: h["h"],
+		Stat: h["s"],
+		Fail: h["f"],
+		Time: h["t"],
+		Proc: h["p"],
+	}
+	s.Rows, _ = strconv.ParseInt(h["r"], 10, 64)
+	s.Done, _ = strconv.ParseInt(h["d"], 10, 64)
+
+	return s, h["o"], nil
+}
+
+// PutJob stores large recognize payload for async processing and returns job status.
+func PutJob(meta, data []byte) (interface{}, error) {
+	m, err := unmarshalMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	err = testHTag(m.HTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRcgn(m.HTag) {
+		return nil, fmt.Errorf("core: invalid htag %s for recognize job", m.HTag)
+	}
+
+	p, err := packMetaData(meta, data)
+	if err != nil {
+		return nil, err
+	}
+
+	o := makeFileName(m.Auth.ID, m.UUID, m.HTag, m.Unix)
+	err = minio.Put(bucketRcgnIn, o, p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setJob(m.UUID, "h", m.HTag, "s", jobQueued, "t", time.Now().String(), "o", o)
+	if err != nil {
+		if err := minio.Del(bucketRcgnIn, o); err != nil {
+			log.Println(err)
+		}
+		return nil, err
+	}
+
+	return jobStat{ID: m.UUID, HTag: m.HTag, Stat: jobQueued}, nil
+}
+
+// GetJob returns status and progress of recognize job.
+// JSON object: {"id":"..."}
+func GetJob(data []byte) (interface{}, error) {
+	q := jobQuery{}
+	err := json.Unmarshal(data, &q)
+	if err != nil {
+		return nil, err
+	}
+
+	s, _, err := getJob(q.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetJobData returns content type and linked result of done recognize job.
+// JSON object: {"id":"...","format":"csv"}
+func GetJobData(data []byte) (string, []byte, error) {
+	q := jobQuery{}
+	err := json.Unmarshal(data, &q)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s, o, err := getJob(q.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if s.Stat != jobDone {
+		return "", nil, fmt.Errorf("core: job %s is %s", q.ID, s.Stat)
+	}
+
+	f, err := minio.Get(bucketRcgnOut, o)
+	if err != nil {
+		return "", nil, err
+	}
+	defer minio.Free(f)
+
+	meta, d, err := unpackMetaData(f)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch q.Format {
+	case "", "json":
+		return "application/json", d, nil
+	case "csv":
+		m, err := unmarshalMeta(meta)
+		if err != nil {
+			return "", nil, err
+		}
+		v, err := unmarshalRcgn(d, m)
+		if err != nil {
+			return "", nil, err
+		}
+		d, err = makeJobCSV(v)
+		return "text/csv; charset=utf-8", d, err
+	}
+
+	return "", nil, fmt.Errorf("core: invalid format %s", q.Format)
+}
+
+func procJob(data []byte) {
+	t := time.Now()
+
+	p, err := decodePath(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	l, err := takeLock(jobLockTTL, "job", p.Object)
+	if err != nil || l == nil {
+		if err != nil {
+			log.Println(err)
+		}
+		return // taken by another worker
+	}
+	defer func() {
+		if err := l.release(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	f, err := minio.Get(p.Bucket, p.Object)
+	if err != nil {
+		log.Println(err) // processed by another worker already
+		return
+	}
+	defer minio.Free(f)
+
+	meta, d, err := unpackMetaData(f)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	m, err := unmarshalMeta(meta)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if s, _, err := getJob(m.UUID); err == nil && (s.Stat == jobDone || s.Stat == jobFailed) {
+		err = minio.Del(p.Bucket, p.Object) // left by worker which stopped before removal
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	err = procJobData(m, d)
+	if err != nil {
+		err = setJob(m.UUID, "s", jobFailed, "f", err.Error(), "p", time.Since(t).String())
+	} else {
+		err = setJob(m.UUID, "s", jobDone, "p", time.Since(t).String())
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = minio.Del(p.Bucket, p.Object)
+	if err != nil {
+		log.Println(err)
+	}
+
+	log.Println("-j-", shortName(p.Object), time.Since(t).String())
+}
+
+func procJobData(m *meta, data []byte) error {
+	v, err := unmarshalRcgn(data, m)
+	if err != nil {
+		return err
+	}
+
+	r := splitJob(v, jobChunk)
+	n := 0
+	for i := range r {
+		n += r[i].len()
+	}
+
+	err = setJob(m.UUID, "s", jobRunning, "r", n)
+	if err != nil {
+		return err
+	}
+
+	n = 0
+	for i := range r {
+		_, err = mineRcgn(r[i], m)
+		if err != nil {
+			return err
+		}
+		n += r[i].len()
+		err = setJob(m.UUID, "d", n)
+		if err != nil {
+			return err
+		}
+	}
+
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	p, err := packMetaData(m.marshal(), d)
+	if err != nil {
+		return err
+	}
+
+	return minio.Put(bucketRcgnOut, makeFileName(m.Auth.ID, m.UUID, m.HTag, m.Unix), p)
+}
+
+// splitJob splits rows into chunks (which share rows with v)
+func splitJob(v interface{}, n int) []ruler {
+	var out []ruler
+	switch v := v.(type) {
+	case jsonRcgnAddr:
+		for len(v) > n {
+			out = append(out, v[:n])
+			v = v[n:]
+		}
+		out = append(out, v)
+	case jsonRcgnDrug:
+		for len(v) > n {
+			out = append(out, v[:n])
+			v = v[n:]
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func makeJobCSV(v interface{}) ([]byte, error) {
+	b := new(bytes.Buffer)
+	w := csv.NewWriter(b)
+
+	var rows [][]string
+	switch v := v.(type) {
+	case jsonRcgnAddr:
+		rows = append(rows, []string{"id", "name", "head", "addr", "code", "key", "id_link", "id_addr", "id_orgn", "id_stat", "egrpou", "match"})
+		for _, r := range v {
+			l := r.Link
+			rows = append(rows, []string{r.ID, r.Name, r.Head, r.Addr, r.Code, l.ID, fmtInt(l.IDLink), fmtInt(l.IDAddr), fmtInt(l.IDOrgn), fmtInt(l.IDStat), l.EGRPOU, l.Match})
+		}
+	case jsonRcgnDrug:
+		rows = append(rows, []string{"id", "name", "barcode", "key", "id_link", "id_drug", "id_brnd", "id_catg", "id_stat", "match"})
+		for _, r := range v {
+			l := r.Link
+			rows = append(rows, []string{r.ID, r.Name, r.Barcode, l.ID, fmtInt(l.IDLink), fmtInt(l.IDDrug), fmtInt(l.IDBrnd), fmtInt(l.IDCatg), fmtInt(l.IDStat), l.Match})
+		}
+	}
+
+	err := w.WriteAll(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func fmtInt(v int64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatInt(v, 10)
+}
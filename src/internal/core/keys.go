@@ -0,0 +1,79 @@
+package core
+
+import (
+	"strings"
+
+	"internal/core/pref"
+)
+
+// Redis key scheme (version 2):
+// <prefix>:vers          => STRING scheme version
+// <prefix>:hset:auth     => HASH auth ID -> name
+// <prefix>:hset:stat     => HASH stat ID -> name
+// <prefix>:zset:meta     => ZSET unix -> UUID
+// <prefix>:meta:<UUID>   => STRING gzipped meta with TTL
+// <prefix>:addr:<SHA1>   => HASH linkAddr
+// <prefix>:drug:<SHA1>   => HASH linkDrug
+const (
+	keyScheme = 2
+
+	nsAddr = "addr"
+	nsDrug = "drug"
+	nsMeta = "meta"
+	nsHset = "hset"
+	nsZset = "zset"
+	nsVers = "vers"
+
+	// legacy (version 1) keys
+	keyAuthV1 = "list:auth"
+	keyStatV1 = "list:stat"
+	keyZlogV1 = "zset:meta"
+)
+
+func makeKey(ns string, id ...string) string {
+	return strings.Join(append([]string{pref.KeyPrefix, ns}, id...), ":")
+}
+
+func keyAuth() string {
+	return makeKey(nsHset, "auth")
+}
+
+func keyStat() string {
+	return makeKey(nsHset, "stat")
+}
+
+func keyZlog() string {
+	return makeKey(nsZset, "meta")
+}
+
+func keyVers() string {
+	return makeKey(nsVers)
+}
+
+func keyMeta(uuid string) string {
+	return makeKey(nsMeta, uuid)
+}
+
+func keyAddr(id string) string {
+	return makeKey(nsAddr, id)
+}
+
+func keyDrug(id string) string {
+	return makeKey(nsDrug, id)
+}
+
+func isOwnKey(k string) bool {
+	return strings.HasPrefix(k, pref.KeyPrefix+":")
+}
+
+func isHexStr(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
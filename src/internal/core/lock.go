@@ -0,0 +1,131 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// STRING => key="<prefix>:lock:<name>" (owner token, expires after ttl)
+// Locks of workers and scheduled runs shared by instances: lock is taken by
+// SET NX PX, extended by heartbeat (every third of ttl) while it is held and
+// removed by its owner only, so lock of crashed worker expires.
+const nsLock = "lock"
+
+type runLock struct {
+	key   string
+	token string
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func keyLock(name ...string) string {
+	return makeKey(nsLock, name...)
+}
+
+// takeLock returns nil if lock is held by another owner
+func takeLock(ttl time.Duration, name ...string) (*runLock, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &runLock{
+		key:   keyLock(name...),
+		token: hex.EncodeToString(b),
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	ok, err := redis.String(c.Do("SET", l.key, l.token, "PX", int64(ttl/time.Millisecond), "NX"))
+	if err != nil && redis.NotErrNil(err) {
+		return nil, err
+	}
+	if ok != "OK" {
+		return nil, nil
+	}
+
+	go l.beat()
+	return l, nil
+}
+
+// beat extends lock until release
+func (l *runLock) beat() {
+	defer close(l.done)
+
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			ok, err := l.owned("PEXPIRE", l.key, int64(l.ttl/time.Millisecond))
+			if err != nil {
+				log.Println(err)
+			}
+			if !ok && err == nil {
+				log.Println("core: lost lock", l.key)
+				return
+			}
+		}
+	}
+}
+
+// release stops heartbeat and removes lock if it is still owned
+func (l *runLock) release() error {
+	close(l.stop)
+	<-l.done
+
+	_, err := l.owned("DEL", l.key)
+	return err
+}
+
+// owned runs command if lock is still owned (false if not)
+func (l *runLock) owned(cmd string, args ...interface{}) (bool, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	_, err := c.Do("WATCH", l.key)
+	if err != nil {
+		return false, err
+	}
+
+	v, err := redis.String(c.Do("GET", l.key))
+	if err != nil && redis.NotErrNil(err) {
+		return false, err
+	}
+	if v != l.token {
+		_, err = c.Do("UNWATCH")
+		return false, err
+	}
+
+	err = c.Send("MULTI")
+	if err != nil {
+		return false, err
+	}
+
+	err = c.Send(cmd, args...)
+	if err != nil {
+		return false, err
+	}
+
+	r, err := c.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+
+	return r != nil, nil
+}
@@ -1,8 +1,11 @@
 package core
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type meta struct {
@@ -26,12 +29,16 @@ type meta struct {
 
 	Link linkAddr `json:"link,omitempty"`
 
-	CTag string `json:"ctag,omitempty"` // *
-	ETag string `json:"etag,omitempty"`
-	Size int64  `json:"size,omitempty"`
-	Proc string `json:"proc,omitempty"`
-	Fail string `json:"fail,omitempty"`
-	Test bool   `json:"test,omitempty"`
+	CTag string            `json:"ctag,omitempty"` // *
+	ETag string            `json:"etag,omitempty"`
+	Size int64             `json:"size,omitempty"`
+	Proc string            `json:"proc,omitempty"`
+	Stat map[string]int64  `json:"stat,omitempty"` // applied effects of statuses
+	Dupe map[string]string `json:"dupe,omitempty"` // unique/rows of lookup keys
+	Fail string            `json:"fail,omitempty"`
+	Test bool              `json:"test,omitempty"`
+	Expl bool              `json:"explain,omitempty"` // * explain links of /recognize
+	Fuzz bool              `json:"fuzzy,omitempty"`   // * link not linked rows of /recognize by fuzzy candidates
 }
 
 func unmarshalMeta(b []byte) (*meta, error) {
@@ -59,6 +66,74 @@ func trimPart(s string) string {
 	return s
 }
 
-func makeFileName(auth, uuid, htag string) string {
-	return fmt.Sprintf("%s_%s_%s.tar", trimPart(auth), trimPart(uuid), htag)
+// Objects of stream and rcgn buckets are named <htag>/<yyyy-mm-dd>/<auth>/<uuid>.tar
+// (date of upload, UTC), so prefix listing works by htag, date and source.
+// Auth element is hex SHA-256 of API key (names are seen by consumers).
+// Names of the former flat scheme (<auth:8>_<uuid:8>_<htag>.tar) are still read.
+const nameDay = "2006-01-02"
+
+func makeFileName(auth, uuid, htag string, unix int64) string {
+	t := time.Now()
+	if unix != 0 {
+		t = time.Unix(unix, 0)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s.tar", namePart(htag), t.UTC().Format(nameDay), authPart(auth), namePart(uuid))
+}
+
+// authPart returns element of object name of API key (key itself is secret)
+func authPart(auth string) string {
+	return sumSHA256([]byte(auth))
+}
+
+// namePart returns s as URL-safe element of object name, s with other
+// characters (or empty) is encoded as "~" + base64url, so names do not collide
+func namePart(s string) string {
+	if s == "" || strings.HasPrefix(s, ".") {
+		return "~" + base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return "~" + base64.RawURLEncoding.EncodeToString([]byte(s))
+		}
+	}
+	return s
+}
+
+// baseName returns last element of object name
+func baseName(o string) string {
+	return o[strings.LastIndex(o, "/")+1:]
+}
+
+// objectHTag returns htag of object name of stream buckets
+func objectHTag(o string) string {
+	if i := strings.Index(o, "/"); i >= 0 {
+		return o[:i]
+	}
+	n := strings.TrimSuffix(strings.TrimSuffix(o, ".txt"), ".tar")
+	s := strings.SplitN(n, "_", 3)
+	if len(s) != 3 {
+		return ""
+	}
+	return s[2]
+}
+
+// shortName returns object name in short form of logs (<auth:8>_<uuid:8>_<htag>.tar)
+func shortName(o string) string {
+	s := strings.Split(o, "/")
+	if len(s) != 4 {
+		return o
+	}
+	return fmt.Sprintf("%s_%s_%s.tar", trimPart(s[2]), trimPart(strings.TrimSuffix(s[3], ".tar")), s[0])
+}
+
+// setDupe reports ratio of unique lookup keys to rows of dict
+func (m *meta) setDupe(dict string, rows, uniq int) {
+	if rows == 0 {
+		return
+	}
+	if m.Dupe == nil {
+		m.Dupe = make(map[string]string)
+	}
+	m.Dupe[dict] = fmt.Sprintf("%d/%d", uniq, rows)
 }
@@ -0,0 +1,339 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"internal/database/redis"
+)
+
+const (
+	migrScan = 1000
+	lenSHA1  = 40
+)
+
+var errKeyScheme = fmt.Errorf("core: legacy redis key scheme found, run migrate")
+
+type migrOpts struct {
+	Dry    bool `json:"dry,omitempty"`
+	Verify bool `json:"verify,omitempty"`
+	Scan   int  `json:"scan,omitempty"`
+}
+
+type migrStat struct {
+	Scheme int              `json:"scheme"`
+	Dry    bool             `json:"dry,omitempty"`
+	Moved  map[string]int64 `json:"moved,omitempty"` // legacy keys moved (or to move if dry)
+	Clash  map[string]int64 `json:"clash,omitempty"` // legacy keys whose target already exists
+	Other  int64            `json:"other,omitempty"` // unknown legacy keys left as is
+	Left   map[string]int64 `json:"left,omitempty"`  // verify: legacy keys left
+	Keys   map[string]int64 `json:"keys,omitempty"`  // verify: keys per namespace
+}
+
+// Migrate moves legacy (version 1) keys to the current key scheme.
+// JSON object: {"dry":false,"verify":true,"scan":1000}
+func Migrate(data []byte) (interface{}, error) {
+	o := migrOpts{}
+	if len(data) > 0 {
+		err := json.Unmarshal(data, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Scan <= 0 {
+		o.Scan = migrScan
+	}
+
+	s := &migrStat{
+		Scheme: keyScheme,
+		Dry:    o.Dry,
+		Moved:  make(map[string]int64),
+		Clash:  make(map[string]int64),
+	}
+
+	err := scanKeys(o.Scan, "", func(keys []string) error {
+		return migrKeys(keys, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.Verify {
+		return s, nil
+	}
+
+	return s, verifyKeys(o.Scan, s)
+}
+
+func scanKeys(n int, match string, f func([]string) error) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	var (
+		cur  = "0"
+		keys []string
+	)
+	for {
+		args := []interface{}{cur, "COUNT", n}
+		if match != "" {
+			args = append(args, "MATCH", match)
+		}
+
+		r, err := redis.Intfs(c.Do("SCAN", args...))
+		if err != nil {
+			return err
+		}
+		if len(r) != 2 {
+			return nil
+		}
+
+		cur, _ = redis.String(r[0], nil)
+		keys, err = redis.Strings(r[1], nil)
+		if err != nil {
+			return err
+		}
+
+		err = f(keys)
+		if err != nil {
+			return err
+		}
+
+		if cur == "0" {
+			return nil
+		}
+	}
+}
+
+func migrKeys(keys []string, s *migrStat) error {
+	kind, err := kindKeysV1(keys)
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if kind[i] == "" {
+			if !isOwnKey(keys[i]) {
+				s.Other++
+			}
+			continue
+		}
+
+		if s.Dry {
+			s.Moved[kind[i]]++
+			continue
+		}
+
+		ok, err := moveKeyV1(keys[i], kind[i])
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.Moved[kind[i]]++
+		} else {
+			s.Clash[kind[i]]++
+		}
+	}
+
+	return nil
+}
+
+func moveKeyV1(k, ns string) (bool, error) {
+	switch k {
+	case keyAuthV1:
+		return true, mergeHash(k, keyAuth())
+	case keyStatV1:
+		return true, mergeHash(k, keyStat())
+	case keyZlogV1:
+		return true, mergeZset(k, keyZlog())
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	return redis.Bool(c.Do("RENAMENX", k, makeKey(ns, k)))
+}
+
+func mergeHash(src, dst string) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	v, err := redis.Strings(c.Do("HGETALL", src))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(v); i += 2 {
+		err = c.Send("HSETNX", dst, v[i], v[i+1])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Send("DEL", src)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("")
+	return err
+}
+
+func mergeZset(src, dst string) error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	err := c.Send("ZUNIONSTORE", dst, 2, dst, src, "AGGREGATE", "MAX")
+	if err != nil {
+		return err
+	}
+
+	err = c.Send("DEL", src)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("")
+	return err
+}
+
+// kindKeysV1 returns namespace for each legacy key or "" if key is not legacy
+func kindKeysV1(keys []string) ([]string, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	out := make([]string, len(keys))
+
+	var err error
+	for i := range keys {
+		err = c.Send("TYPE", keys[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	t := make([]string, len(keys))
+	for i := range keys {
+		t[i], err = redis.String(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := make([]int, 0, len(keys))
+	for i := range keys {
+		switch {
+		case isOwnKey(keys[i]):
+			continue
+		case keys[i] == keyAuthV1, keys[i] == keyStatV1:
+			out[i] = nsHset
+		case keys[i] == keyZlogV1:
+			out[i] = nsZset
+		case t[i] == "string" && isHexStr(keys[i]) && len(keys[i]) != lenSHA1:
+			out[i] = nsMeta
+		case t[i] == "hash" && isHexStr(keys[i]) && len(keys[i]) == lenSHA1:
+			hash = append(hash, i)
+			err = c.Send("HKEYS", keys[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(hash) == 0 {
+		return out, nil
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	var f []string
+	for _, i := range hash {
+		f, err = redis.Strings(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		out[i] = kindHashV1(f)
+	}
+
+	return out, nil
+}
+
+func kindHashV1(f []string) string {
+	for i := range f {
+		switch f[i] {
+		case fldsDrug[1], fldsDrug[2], fldsDrug[3]: // "d", "b", "c"
+			return nsDrug
+		case fldsAddr[1], fldsAddr[2], fldsAddr[4]: // "a", "o", "e"
+			return nsAddr
+		}
+	}
+	return ""
+}
+
+func verifyKeys(n int, s *migrStat) error {
+	s.Left = make(map[string]int64)
+	s.Keys = make(map[string]int64)
+
+	err := scanKeys(n, "", func(keys []string) error {
+		kind, err := kindKeysV1(keys)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if kind[i] != "" {
+				s.Left[kind[i]]++
+				continue
+			}
+			if isOwnKey(keys[i]) {
+				s.Keys[nameSpace(keys[i])]++
+			}
+		}
+		return nil
+	})
+	if err != nil || s.Dry || len(s.Left) > 0 {
+		return err
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	_, err = c.Do("SET", keyVers(), keyScheme)
+	return err
+}
+
+func nameSpace(k string) string {
+	s := strings.SplitN(strings.TrimPrefix(k, makeKey("")), ":", 2)
+	return s[0]
+}
+
+func testKeyScheme() error {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	v, err := redis.Int64(c.Do("GET", keyVers()))
+	if err != nil && redis.NotErrNil(err) {
+		return err
+	}
+	if v == keyScheme {
+		return nil
+	}
+
+	// legacy keys are not read by this scheme: refuse to serve empty dictionaries
+	n, err := redis.Int64(c.Do("EXISTS", keyAuthV1, keyStatV1, keyZlogV1))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errKeyScheme
+	}
+
+	return nil
+}
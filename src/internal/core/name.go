@@ -0,0 +1,394 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:name:<dict>" (dict is drug, brnd, catg or orgn)
+// HSET key i->n [i->n...]
+// HMGET key i [i..]
+// JSON object: {"dict":"brnd","list":[{"id":1,"name":"name1"}]}
+//
+// HASH => key="<prefix>:hset:rich"
+// HSET key <auth>->dicts or route:<bucket>->dicts (comma separated)
+// Enrichment rules of outputs: names of which dicts are added to links
+// of popped data, rule of consumer (auth ID) overrides rule of route (bucket).
+const (
+	dictNameDrug = "name:drug"
+	dictNameBrnd = "name:brnd"
+	dictNameCatg = "name:catg"
+	dictNameOrgn = "name:orgn"
+	dictRich     = "rich"
+
+	richRoute = "route:"
+)
+
+// listNames maps short dict names of API to dictionaries (stat is the legacy one)
+var listNames = map[string]string{
+	"drug": dictNameDrug,
+	"brnd": dictNameBrnd,
+	"catg": dictNameCatg,
+	"orgn": dictNameOrgn,
+	"stat": dictStat,
+}
+
+// linkNames holds display names of IDs of a link
+type linkNames struct {
+	Drug string `json:"drug,omitempty"`
+	Brnd string `json:"brnd,omitempty"`
+	Catg string `json:"catg,omitempty"`
+	Orgn string `json:"orgn,omitempty"`
+	Stat string `json:"stat,omitempty"`
+}
+
+type itemName struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+type nameQuery struct {
+	Dict string     `json:"dict"`
+	IDs  []int64    `json:"ids,omitempty"`
+	List []itemName `json:"list,omitempty"`
+}
+
+type richRule struct {
+	ID    string   `json:"id"` // auth ID or "route:<bucket>"
+	Dicts []string `json:"dicts,omitempty"`
+}
+
+func keyName(dict string) string {
+	return makeKey(nsHset, dict)
+}
+
+func keyRich() string {
+	return makeKey(nsHset, dictRich)
+}
+
+func isNameDict(dict string) bool {
+	switch dict {
+	case dictNameDrug, dictNameBrnd, dictNameCatg, dictNameOrgn:
+		return true
+	}
+	return false
+}
+
+func parseNameQuery(data []byte) (nameQuery, error) {
+	q := nameQuery{}
+	err := json.Unmarshal(data, &q)
+	if err != nil {
+		return q, err
+	}
+
+	d, ok := listNames[q.Dict]
+	if !ok {
+		return q, fmt.Errorf("core: invalid dict %s", q.Dict)
+	}
+	q.Dict = d
+
+	return q, nil
+}
+
+func formatIDs(v []int64) []string {
+	out := make([]string, len(v))
+	for i := range v {
+		out[i] = strconv.FormatInt(v[i], 10)
+	}
+	return out
+}
+
+// GetName returns names of IDs.
+// JSON object: {"dict":"brnd","ids":[1,2]}
+func GetName(data []byte) (interface{}, error) {
+	q, err := parseNameQuery(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := readDict(q.Dict, formatIDs(q.IDs))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]itemName, len(q.IDs))
+	for i := range q.IDs {
+		out[i] = itemName{ID: q.IDs[i], Name: r[i][fldName]}
+	}
+
+	return out, nil
+}
+
+// SetName sets names of IDs.
+// JSON object: {"dict":"brnd","list":[{"id":1,"name":"name1"}]}
+func SetName(data []byte, auth, uuid string) (interface{}, error) {
+	q, err := parseNameQuery(data)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: q.Dict,
+		keys: make([]string, len(q.List)),
+		vals: make([]map[string]string, len(q.List)),
+	}
+	for i := range q.List {
+		w.keys[i] = strconv.FormatInt(q.List[i].ID, 10)
+		w.vals[i] = nameHash(q.List[i].Name)
+	}
+
+	err = testNames(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
+
+// DelName deletes names of IDs.
+// JSON object: {"dict":"brnd","ids":[1,2]}
+func DelName(data []byte, auth, uuid string) (interface{}, error) {
+	q, err := parseNameQuery(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(&dictWrite{dict: q.Dict, keys: formatIDs(q.IDs)}, actor{auth, uuid})
+}
+
+// GetRich returns enrichment rules.
+// JSON array: ["auth1","route:stream-out.geo"]
+func GetRich(data []byte) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := readDict(dictRich, v)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]richRule, len(v))
+	for i := range v {
+		out[i] = richRule{ID: v[i], Dicts: splitDicts(r[i][fldName])}
+	}
+
+	return out, nil
+}
+
+// SetRich sets enrichment rules.
+// JSON array: [{"id":"auth1","dicts":["drug","brnd","stat"]}]
+func SetRich(data []byte, auth, uuid string) (interface{}, error) {
+	var v []richRule
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: dictRich,
+		keys: make([]string, len(v)),
+		vals: make([]map[string]string, len(v)),
+	}
+	for i := range v {
+		for _, d := range v[i].Dicts {
+			if _, ok := listNames[d]; !ok {
+				return nil, fmt.Errorf("core: invalid dict %s", d)
+			}
+		}
+		w.keys[i] = v[i].ID
+		w.vals[i] = nameHash(strings.Join(v[i].Dicts, ","))
+	}
+
+	err = testNames(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
+
+// DelRich deletes enrichment rules.
+// JSON array: ["auth1","route:stream-out.geo"]
+func DelRich(data []byte, auth, uuid string) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(&dictWrite{dict: dictRich, keys: v}, actor{auth, uuid})
+}
+
+func splitDicts(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// getRich returns dicts for consumer or route ("" if outputs are not enriched)
+func getRich(auth, bucket string) ([]string, error) {
+	r, err := readDict(dictRich, []string{auth, richRoute + bucket})
+	if err != nil {
+		return nil, err
+	}
+
+	if r[0][fldName] != "" {
+		return splitDicts(r[0][fldName]), nil
+	}
+
+	return splitDicts(r[1][fldName]), nil
+}
+
+// richData adds names to links of data compressed by enc by rules of consumer or route
+func richData(auth, bucket string, meta, data []byte, enc string) ([]byte, error) {
+	dicts, err := getRich(auth, bucket)
+	if err != nil || len(dicts) == 0 {
+		return data, err
+	}
+
+	m, err := unmarshalMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := decodeData(data, enc)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := unmarshalDataNEW(d, m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = richLinks(v, dicts)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err = json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeData(d, enc)
+}
+
+// richLinks fills names of links of output rows
+func richLinks(v interface{}, dicts []string) error {
+	var (
+		drug []*linkDrug
+		addr []*linkAddr
+	)
+	switch v := v.(type) {
+	case jsonV3Geoa:
+		for i := range v {
+			drug = append(drug, &v[i].Link)
+		}
+	case jsonV3Sale:
+		for i := range v {
+			drug = append(drug, &v[i].LinkDrug)
+			addr = append(addr, &v[i].LinkAddr)
+		}
+	case jsonV3SaleBy:
+		for i := range v {
+			drug = append(drug, &v[i].Link)
+		}
+	}
+
+	for _, l := range drug {
+		l.Names = &linkNames{}
+	}
+	for _, l := range addr {
+		l.Names = &linkNames{}
+	}
+
+	for _, d := range dicts {
+		var (
+			ids  []int64
+			dst  []*string
+			dict = listNames[d]
+		)
+		for _, l := range drug {
+			switch d {
+			case "drug":
+				ids, dst = append(ids, l.IDDrug), append(dst, &l.Names.Drug)
+			case "brnd":
+				ids, dst = append(ids, l.IDBrnd), append(dst, &l.Names.Brnd)
+			case "catg":
+				ids, dst = append(ids, l.IDCatg), append(dst, &l.Names.Catg)
+			case "stat":
+				ids, dst = append(ids, l.IDStat), append(dst, &l.Names.Stat)
+			}
+		}
+		for _, l := range addr {
+			switch d {
+			case "orgn":
+				ids, dst = append(ids, l.IDOrgn), append(dst, &l.Names.Orgn)
+			case "stat":
+				ids, dst = append(ids, l.IDStat), append(dst, &l.Names.Stat)
+			}
+		}
+
+		names, err := getNames(dict, ids)
+		if err != nil {
+			return err
+		}
+		for i := range dst {
+			*dst[i] = names[ids[i]]
+		}
+	}
+
+	return nil
+}
+
+// getNames returns names of unique non-zero IDs of dict
+func getNames(dict string, ids []int64) (map[int64]string, error) {
+	out := make(map[int64]string)
+	vls := []interface{}{}
+	var uniq []int64
+	for _, id := range ids {
+		if _, ok := out[id]; ok || id == 0 {
+			continue
+		}
+		out[id] = ""
+		uniq = append(uniq, id)
+	}
+
+	if len(uniq) == 0 {
+		return out, nil
+	}
+
+	k, _, err := dictKey(dict, "0")
+	if err != nil {
+		return nil, err
+	}
+
+	vls = append(vls, k)
+	for _, id := range uniq {
+		vls = append(vls, id)
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	r, err := redis.Strings(c.Do("HMGET", vls...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range uniq {
+		out[uniq[i]] = r[i]
+	}
+
+	return out, nil
+}
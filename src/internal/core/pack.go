@@ -3,94 +3,407 @@ package core
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"time"
 
 	"internal/compress/gziputil"
+	"internal/compress/zstdutil"
+	"internal/core/pref"
 )
 
+// Package is tar of manifest.json and members: meta.json.gz, data.json.gz
+// and optional extra members (validation reports, original raw files).
+// Manifest holds format version, size, SHA-256, content type and encoding
+// of every member; readers verify members by manifest and fail on
+// mismatches and unknown members. Packages without manifest (version 1)
+// are read as before, without verification. Members of encrypted packages
+// are checked as stored (encrypted), see crypt.go.
+// Meta and data are compressed by pref.Codec (gzip or zstd), encoding is
+// recorded per member, so members keep their names (.json.gz) and packages
+// of any codec are readable.
 const (
-	tarMeta = "meta.json.gz"
-	tarData = "data.json.gz"
+	tarManifest = "manifest.json"
+	tarMeta     = "meta.json.gz"
+	tarData     = "data.json.gz"
+
+	packVersion = 2
+
+	typeJSON = "application/json"
+	encGzip  = "gzip"
+	encZstd  = "zstd"
 )
 
-func packMetaData(m, d []byte) (io.Reader, error) {
-	b := new(bytes.Buffer)
-	t := tar.NewWriter(b)
+type packMember struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+
+	data   []byte // content to pack
+	stored bool   // data is encoded already
+}
+
+type packManifest struct {
+	Version int          `json:"version"`
+	Crypt   *packCrypt   `json:"crypt,omitempty"`
+	Members []packMember `json:"members"`
+}
 
-	err := writeGzTar(tarMeta, m, t)
+// pack is unpacked package
+type pack struct {
+	manifest packManifest
+	members  map[string][]byte // stored content by name
+	key      []byte            // data key of encrypted package
+}
+
+func packMetaData(m, d []byte, extra ...packMember) (io.Reader, error) {
+	v := make([]packMember, 0, len(extra)+2)
+	v = append(v,
+		packMember{Name: tarMeta, Type: typeJSON, Encoding: pref.Codec, data: m},
+		packMember{Name: tarData, Type: typeJSON, Encoding: pref.Codec, data: d},
+	)
+	v = append(v, extra...)
+
+	return writePack(v)
+}
+
+// writePack encodes members (if encoding is set and data is not stored
+// content), encrypts them if master key is set and writes package
+func writePack(v []packMember) (io.Reader, error) {
+	k, c, err := newDataKey()
 	if err != nil {
 		return nil, err
 	}
 
-	err = writeGzTar(tarData, d, t)
+	p := &pack{
+		manifest: packManifest{Version: packVersion, Crypt: c, Members: make([]packMember, len(v))},
+		members:  make(map[string][]byte, len(v)),
+	}
+	for i := range v {
+		if v[i].Name == tarManifest || p.members[v[i].Name] != nil {
+			return nil, fmt.Errorf("core: invalid package member %s", v[i].Name)
+		}
+		b := v[i].data
+		if v[i].Encoding != "" && !v[i].stored {
+			b, err = encodeData(b, v[i].Encoding)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if k != nil {
+			b, err = sealData(k, b, []byte(v[i].Name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.manifest.Members[i] = packMember{
+			Name:     v[i].Name,
+			Type:     v[i].Type,
+			Encoding: v[i].Encoding,
+			Size:     int64(len(b)),
+			SHA256:   sumSHA256(b),
+		}
+		p.members[v[i].Name] = b
+	}
+
+	return p.write()
+}
+
+// write writes manifest and stored members
+func (p *pack) write() (io.Reader, error) {
+	h, err := json.Marshal(p.manifest)
 	if err != nil {
 		return nil, err
 	}
 
-	err = t.Close()
+	b := new(bytes.Buffer)
+	t := tar.NewWriter(b)
+
+	err = writeTar(tarManifest, h, t)
 	if err != nil {
 		return nil, err
 	}
 
-	return b, nil
-}
+	for _, m := range p.manifest.Members {
+		err = writeTar(m.Name, p.members[m.Name], t)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func writeGzTar(name string, data []byte, w *tar.Writer) error {
-	d, err := gziputil.MustCompress(data)
+	err = t.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return b, nil
+}
+
+func writeTar(name string, data []byte, w *tar.Writer) error {
 	h := &tar.Header{
 		Name:    name,
 		Mode:    0666,
 		ModTime: time.Now(),
-		Size:    int64(len(d)),
+		Size:    int64(len(data)),
 	}
 
-	err = w.WriteHeader(h)
+	err := w.WriteHeader(h)
 	if err != nil {
 		return err
 	}
 
-	_, err = w.Write(d)
+	_, err = w.Write(data)
 	return err
 }
 
-func unpackMetaData(r io.Reader, gz ...bool) ([]byte, []byte, error) {
-	tr := tar.NewReader(r)
+func testCodec(enc string) error {
+	if enc != encGzip && enc != encZstd {
+		return fmt.Errorf("core: unsupported codec %s", enc)
+	}
+	return nil
+}
+
+// detectEncoding returns encoding of data (empty if data is not compressed)
+func detectEncoding(b []byte) string {
+	switch {
+	case zstdutil.Detect(b):
+		return encZstd
+	case gziputil.InString(http.DetectContentType(b)):
+		return encGzip
+	}
+	return ""
+}
+
+// encodeData compresses data by enc, data compressed by other codec is recoded
+func encodeData(b []byte, enc string) ([]byte, error) {
+	e := detectEncoding(b)
+	if e == enc {
+		return b, nil
+	}
+
+	b, err := decodeData(b, e)
+	if err != nil {
+		return nil, err
+	}
+
+	switch enc {
+	case encGzip:
+		return gziputil.Compress(b)
+	case encZstd:
+		return zstdutil.Compress(b)
+	case "":
+		return b, nil
+	}
+	return nil, fmt.Errorf("core: unsupported encoding %s", enc)
+}
+
+func decodeData(b []byte, enc string) ([]byte, error) {
+	switch enc {
+	case encGzip:
+		return gziputil.Uncompress(b)
+	case encZstd:
+		return zstdutil.Uncompress(b)
+	case "":
+		return b, nil
+	}
+	return nil, fmt.Errorf("core: unsupported encoding %s", enc)
+}
+
+func sumSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// readPack reads package without verification
+func readPack(r io.Reader) (*pack, error) {
+	p := &pack{members: make(map[string][]byte)}
+
 	var (
-		m = new(bytes.Buffer)
-		d = new(bytes.Buffer)
+		h    *tar.Header
+		b    []byte
+		err  error
+		list []string
 	)
+	tr := tar.NewReader(r)
 	for {
-		h, err := tr.Next()
+		h, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err = ioutil.ReadAll(tr)
 		if err != nil {
-			if err == io.EOF {
-				break
+			return nil, err
+		}
+		if h.Name == tarManifest {
+			err = json.Unmarshal(b, &p.manifest)
+			if err != nil {
+				return nil, fmt.Errorf("core: invalid package manifest: %v", err)
+			}
+			continue
+		}
+		p.members[h.Name] = b
+		list = append(list, h.Name)
+	}
+
+	if p.manifest.Version == 0 { // version 1: no manifest
+		p.manifest.Version = 1
+		for _, n := range list {
+			m := packMember{Name: n, Size: int64(len(p.members[n]))}
+			if strings.HasSuffix(n, ".json.gz") {
+				m.Type, m.Encoding = typeJSON, encGzip
 			}
-			return nil, nil, err
+			p.manifest.Members = append(p.manifest.Members, m)
 		}
+	}
+
+	return p, nil
+}
+
+// verify returns mismatches of members and manifest
+func (p *pack) verify() []string {
+	if p.manifest.Version == 1 {
+		return nil
+	}
+
+	var fail []string
+	if p.manifest.Version > packVersion {
+		fail = append(fail, fmt.Sprintf("unsupported version %d", p.manifest.Version))
+	}
+
+	seen := make(map[string]bool, len(p.manifest.Members))
+	for _, m := range p.manifest.Members {
+		seen[m.Name] = true
+		b, ok := p.members[m.Name]
 		switch {
-		case h.Name == tarMeta:
-			err = copyMetaData(m, tr, len(gz) > 1 && gz[0])
-		case h.Name == tarData:
-			err = copyMetaData(d, tr, len(gz) == 2 && gz[1])
+		case !ok:
+			fail = append(fail, m.Name+": missing")
+		case int64(len(b)) != m.Size:
+			fail = append(fail, fmt.Sprintf("%s: size %d != %d", m.Name, len(b), m.Size))
+		case sumSHA256(b) != m.SHA256:
+			fail = append(fail, m.Name+": sha256 mismatch")
+		}
+	}
+
+	for n := range p.members {
+		if !seen[n] {
+			fail = append(fail, n+": unknown member")
+		}
+	}
+
+	return fail
+}
+
+// unpackPack reads and verifies package
+func unpackPack(r io.Reader) (*pack, error) {
+	p, err := readPack(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if fail := p.verify(); len(fail) != 0 {
+		return nil, fmt.Errorf("core: package is corrupted: %s", strings.Join(fail, ", "))
+	}
+
+	return p, nil
+}
+
+// member returns decrypted and decoded content of member (encoded if raw)
+func (p *pack) member(name string, raw bool) ([]byte, error) {
+	b := p.members[name]
+	if len(b) == 0 {
+		return b, nil
+	}
+
+	if c := p.manifest.Crypt; c != nil {
+		var err error
+		if p.key == nil {
+			p.key, err = c.dataKey()
+			if err != nil {
+				return nil, err
+			}
 		}
+		b, err = openData(p.key, b, []byte(name))
 		if err != nil {
-			return nil, nil, err
+			return nil, fmt.Errorf("core: decrypt %s: %v", name, err)
 		}
 	}
 
-	return m.Bytes(), d.Bytes(), nil
+	if raw {
+		return b, nil
+	}
+
+	return decodeData(b, p.encoding(name))
 }
 
-func copyMetaData(dst io.Writer, src io.Reader, gz bool) error {
-	if gz {
-		_, err := io.Copy(dst, src)
-		return err
+// memberAs returns content of member compressed by enc (as stored if
+// member is compressed by enc already)
+func (p *pack) memberAs(name, enc string) ([]byte, error) {
+	b, err := p.member(name, true)
+	if err != nil || len(b) == 0 {
+		return b, err
+	}
 
+	e := p.encoding(name)
+	if e == enc {
+		return b, nil
 	}
-	return gziputil.Copy(dst, src)
+
+	b, err = decodeData(b, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeData(b, enc)
+}
+
+// encoding returns encoding of member by manifest
+func (p *pack) encoding(name string) string {
+	for _, m := range p.manifest.Members {
+		if m.Name == name {
+			return m.Encoding
+		}
+	}
+	return ""
+}
+
+// unpackMetaData returns meta and data of package, enc[0] keeps data
+// compressed by given codec (gzip or zstd)
+func unpackMetaData(r io.Reader, enc ...string) ([]byte, []byte, error) {
+	m, d, _, err := unpackMetaDataPack(r, enc...)
+	return m, d, err
+}
+
+func unpackMetaDataPack(r io.Reader, enc ...string) ([]byte, []byte, *pack, error) {
+	p, err := unpackPack(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	m, err := p.member(tarMeta, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var d []byte
+	if len(enc) != 0 && enc[0] != "" {
+		d, err = p.memberAs(tarData, enc[0])
+	} else {
+		d, err = p.member(tarData, false)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return m, d, p, nil
 }
@@ -0,0 +1,374 @@
+package core
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:norm"
+// HSET key SHA1(canonical notation)->ID (SHA1 of drug link)
+// Index of parsed drug names, learned from rows linked by name,
+// links other notations of the same product (pack size, strength, form).
+const (
+	matchNorm = "notation"
+)
+
+// drugName is a drug name split into components
+type drugName struct {
+	Name string `json:"name,omitempty"` // trade name
+	Form string `json:"form,omitempty"` // dosage form (canonical)
+	Dose string `json:"dose,omitempty"` // strength, "500" or "500/125"
+	Unit string `json:"unit,omitempty"` // unit of strength (canonical)
+	Pack int    `json:"pack,omitempty"` // pack count
+}
+
+// drugForms maps UA/RU/KZ/BY/latin notations of dosage forms to canonical names
+var drugForms = map[string]string{
+	"табл": "tab", "таб": "tab", "таблетки": "tab", "таблетка": "tab", "таблеток": "tab",
+	"таблеткі": "tab", "таблеткалар": "tab", "tab": "tab", "tabl": "tab", "tabs": "tab",
+	"капс": "caps", "капсули": "caps", "капсула": "caps", "капсулы": "caps", "капсул": "caps",
+	"капсулалар": "caps", "caps": "caps", "cap": "caps",
+	"р-р": "sol", "р-н": "sol", "розч": "sol", "розчин": "sol", "раствор": "sol", "ерітінді": "sol",
+	"sol": "sol",
+	"амп": "amp", "ампули": "amp", "ампулы": "amp", "ампул": "amp", "amp": "amp",
+	"мазь": "oint", "ung": "oint",
+	"крем": "cream", "cream": "cream",
+	"гель": "gel", "gel": "gel",
+	"сироп": "syr", "сіроп": "syr", "syr": "syr",
+	"супп": "supp", "супоз": "supp", "свічки": "supp", "свечи": "supp", "свечы": "supp", "supp": "supp",
+	"краплі": "drops", "капли": "drops", "кроплі": "drops", "gtt": "drops",
+	"спрей": "spray", "spray": "spray",
+	"аерозоль": "aer", "аэрозоль": "aer", "аэразоль": "aer",
+	"пор": "pulv", "порошок": "pulv", "парашок": "pulv", "pulv": "pulv",
+	"сусп": "susp", "суспензія": "susp", "суспензия": "susp", "суспензiя": "susp", "susp": "susp",
+	"драже":   "dragee",
+	"пластир": "plast", "пластырь": "plast",
+}
+
+// drugUnits maps notations of strength units to canonical names
+var drugUnits = map[string]string{
+	"мг": "mg", "мгр": "mg", "mg": "mg",
+	"г": "g", "гр": "g", "g": "g",
+	"мкг": "mcg", "мкгр": "mcg", "mcg": "mcg", "µg": "mcg",
+	"мл": "ml", "ml": "ml",
+	"%":  "%",
+	"мо": "iu", "ме": "iu", "од": "iu", "ед": "iu", "iu": "iu",
+	"доза": "dose", "доз": "dose", "дозы": "dose", "дози": "dose", "dose": "dose",
+}
+
+// packMarks precede pack count: "№20", "N20", "#20"
+var packMarks = map[string]bool{
+	"№": true, "n": true, "#": true, "no": true,
+}
+
+// packUnits follow pack count: "20 шт"
+var packUnits = map[string]bool{
+	"шт": true, "штук": true, "дана": true, "pcs": true,
+}
+
+// parseDrugName extracts trade name, dosage form, strength and pack count
+// from free-text drug name, components which are not found are left empty
+func parseDrugName(s string) drugName {
+	var (
+		d    drugName
+		name []string
+		done bool // trade name ends at the first recognized component
+	)
+
+	t := tokenizeName(s)
+	for i := 0; i < len(t); i++ {
+		l := strings.ToLower(t[i])
+		switch {
+		case packMarks[l] && i+1 < len(t) && isNumber(t[i+1]):
+			n, k := parsePack(t, i+1)
+			if d.Pack == 0 {
+				d.Pack = n
+			}
+			i = k
+			done = true
+		case isNumber(l) && i+1 < len(t) && drugUnits[parseUnit(t[i+1])] != "":
+			if d.Dose == "" {
+				d.Dose = trimZeros(l)
+				d.Unit = canonUnit(t[i+1])
+			}
+			i++
+			done = true
+		case isNumber(l) && i+1 < len(t) && packUnits[strings.ToLower(t[i+1])]:
+			if d.Pack == 0 {
+				d.Pack, _ = strconv.Atoi(l)
+			}
+			i++
+			done = true
+		case drugForms[l] != "":
+			if d.Form == "" {
+				d.Form = drugForms[l]
+			}
+			done = true
+		case !done:
+			name = append(name, t[i])
+		}
+	}
+
+	d.Name = strings.Join(name, " ")
+	return d
+}
+
+// canon returns canonical notation of the drug name or "" if there is
+// nothing but trade name (which is linked by the whole name anyway)
+func (d drugName) canon() string {
+	if d.Name == "" || d.Form == "" && d.Dose == "" && d.Pack == 0 {
+		return ""
+	}
+
+	return strings.Join([]string{
+		strings.ToLower(d.Name),
+		d.Form,
+		d.Dose + d.Unit,
+		strconv.Itoa(d.Pack),
+	}, "|")
+}
+
+// parsePack returns pack count starting at i ("10", "10 x 2", "2*10")
+// and index of the last token of the count
+func parsePack(t []string, i int) (int, int) {
+	n, _ := strconv.Atoi(t[i])
+	for i+2 < len(t) && isMultiply(t[i+1]) && isNumber(t[i+2]) {
+		m, _ := strconv.Atoi(t[i+2])
+		n *= m
+		i += 2
+	}
+	return n, i
+}
+
+// trimZeros removes trailing zeros of decimals ("2.50" -> "2.5", "1.0" -> "1")
+func trimZeros(s string) string {
+	p := strings.Split(s, "/")
+	for i := range p {
+		if strings.Contains(p[i], ".") {
+			p[i] = strings.TrimRight(strings.TrimRight(p[i], "0"), ".")
+		}
+	}
+	return strings.Join(p, "/")
+}
+
+func isMultiply(s string) bool {
+	switch strings.ToLower(s) {
+	case "x", "х", "*":
+		return true
+	}
+	return false
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && r != '.' && r != '/' {
+			return false
+		}
+	}
+	return s[0] != '.' && s[0] != '/'
+}
+
+// parseUnit returns the first part of compound unit ("мг/мл" -> "мг")
+func parseUnit(s string) string {
+	return strings.ToLower(strings.SplitN(s, "/", 2)[0])
+}
+
+// canonUnit returns canonical unit, compound units are kept ("мг/мл" -> "mg/ml")
+func canonUnit(s string) string {
+	p := strings.Split(strings.ToLower(s), "/")
+	for i := range p {
+		if u, ok := drugUnits[p[i]]; ok {
+			p[i] = u
+		}
+	}
+	return strings.Join(p, "/")
+}
+
+// tokenizeName splits name into words, numbers and symbols:
+// "Парацетамол табл.500мг №10х2" -> [Парацетамол табл 500 мг № 10 х 2]
+// decimal commas are replaced by points
+func tokenizeName(s string) []string {
+	var (
+		r   = []rune(s)
+		out []string
+		cur []rune
+		cls int
+	)
+
+	push := func() {
+		if len(cur) > 0 {
+			out = append(out, strings.Trim(string(cur), "/-"))
+		}
+		cur = cur[:0]
+		cls = 0
+	}
+
+	for i := range r {
+		c := classRune(r, i)
+		switch {
+		case c == 0:
+			push()
+			continue
+		case c == 3:
+			push()
+			out = append(out, string(r[i]))
+			continue
+		case c != cls:
+			push()
+		}
+		cls = c
+		if r[i] == ',' {
+			cur = append(cur, '.')
+		} else {
+			cur = append(cur, r[i])
+		}
+	}
+	push()
+
+	n := 0
+	for i := range out {
+		if out[i] != "" {
+			out[n] = out[i]
+			n++
+		}
+	}
+
+	return out[:n]
+}
+
+// classRune returns 0 for separators, 1 for digits, 2 for letters and 3 for symbols,
+// points/commas between digits belong to numbers, slashes and hyphens join neighbours
+func classRune(r []rune, i int) int {
+	prev := func() rune {
+		if i > 0 {
+			return r[i-1]
+		}
+		return ' '
+	}
+	next := func() rune {
+		if i+1 < len(r) {
+			return r[i+1]
+		}
+		return ' '
+	}
+
+	switch c := r[i]; {
+	case unicode.IsDigit(c):
+		return 1
+	case c == '.' || c == ',':
+		if unicode.IsDigit(prev()) && unicode.IsDigit(next()) {
+			return 1
+		}
+		return 0
+	case c == '/':
+		switch {
+		case unicode.IsDigit(prev()) && unicode.IsDigit(next()):
+			return 1
+		case unicode.IsLetter(prev()) && unicode.IsLetter(next()):
+			return 2
+		}
+		return 0
+	case c == '-' || c == '\'' || c == '’' || c == 'ʼ':
+		if unicode.IsLetter(prev()) && unicode.IsLetter(next()) {
+			return 2
+		}
+		return 0
+	case c == '%' || c == '№' || c == '#' || c == '*':
+		return 3
+	case unicode.IsLetter(c) || c == 'µ':
+		return 2
+	}
+
+	return 0
+}
+
+func keyNorm() string {
+	return makeKey(nsHset, "norm")
+}
+
+// getNormDrug returns drug keys by canonical notation keys ("" if unknown)
+func getNormDrug(v []string) ([]string, error) {
+	return getHashFields(keyNorm(), v)
+}
+
+// getLinkNorm returns drug links by canonical notation keys
+func getLinkNorm(v []string) ([]linkDrug, error) {
+	ids, err := getNormDrug(v)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := getLinkDrugCache(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range out {
+		if ids[i] == "" {
+			out[i] = linkDrug{}
+		}
+	}
+
+	return out, nil
+}
+
+// putNormDrug remembers drug keys of canonical notations linked by name,
+// notations which are already known are kept
+func putNormDrug(norm, keys []string) error {
+	if len(norm) == 0 {
+		return nil
+	}
+
+	uniq, idx := uniqKeys(norm)
+	look := make([]string, len(uniq))
+	for i := range norm {
+		if look[idx[i]] == "" {
+			look[idx[i]] = keys[i]
+		}
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	for p := 0; p < len(uniq); p += lookChunk {
+		q := lookEnd(p, len(uniq))
+		for i := p; i < q; i++ {
+			err := c.Send("HSETNX", keyNorm(), uniq[i], look[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := c.Do("")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseName returns components of drug names.
+// JSON array: ["Парацетамол табл. 500мг №20"]
+func ParseName(data []byte) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]drugName, len(v))
+	for i := range v {
+		out[i] = parseDrugName(v[i])
+	}
+
+	return out, nil
+}
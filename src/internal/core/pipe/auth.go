@@ -5,7 +5,8 @@ import (
 	"net/http"
 )
 
-func Auth(fn func(string) bool) handler {
+// Auth checks key by fn, errors of fn fail request (key is not passed)
+func Auth(fn func(string) (bool, error)) handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
@@ -13,12 +14,15 @@ func Auth(fn func(string) bool) handler {
 			var ok bool
 			key, err := getKey(r)
 			if key != "" {
-				ok = fn(key)
+				ok, err = fn(key)
 			}
 
-			if ok {
+			switch {
+			case ok:
 				ctx = withAuth(ctx, key)
-			} else {
+			case key != "" && err != nil:
+				ctx = withFail(ctx, err)
+			default:
 				if err == nil {
 					err = fmt.Errorf("pipe: invalid key: %s: forbidden", key)
 				}
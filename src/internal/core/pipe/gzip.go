@@ -1,11 +1,19 @@
 package pipe
 
 import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 
 	"internal/compress/gziputil"
+	"internal/compress/zstdutil"
 )
 
+// Gzip decodes request body (Content-Encoding gzip or zstd) and encodes
+// response by Accept-Encoding (zstd is preferred to gzip). Response which
+// has Content-Encoding set by handler (packed data) is written as is.
 func Gzip(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -15,10 +23,24 @@ func Gzip(next http.Handler) http.Handler {
 			return
 		}
 
-		if gziputil.InString(r.Header.Get("Content-Encoding")) {
+		switch v := r.Header.Get("Content-Encoding"); {
+		case zstdutil.InString(v):
+			z, err := zstdutil.GetReader()
+			if err != nil {
+				ctx = withFail(ctx, err)
+				break
+			}
+			defer func() { _ = zstdutil.PutReader(z) }()
+			err = z.Reset(r.Body)
+			if err != nil {
+				ctx = withFail(ctx, err)
+			}
+			r.Body = ioutil.NopCloser(z)
+		case gziputil.InString(v):
 			z, err := gziputil.GetReader()
 			if err != nil {
 				ctx = withFail(ctx, err)
+				break
 			}
 			defer func() { _ = gziputil.PutReader(z) }()
 			err = z.Reset(r.Body)
@@ -28,18 +50,106 @@ func Gzip(next http.Handler) http.Handler {
 			r.Body = z
 		}
 
-		if gziputil.InString(r.Header.Get("Accept-Encoding")) {
-			z, err := gziputil.GetWriter()
-			if err != nil {
-				ctx = withFail(ctx, err)
-			}
-			defer func() { _ = gziputil.PutWriter(z) }()
-			z.Reset(w)
-			w = gziputil.ResponseWriter{Writer: z, ResponseWriter: w}
+		if v := r.Header.Get("Accept-Encoding"); zstdutil.InString(v) || gziputil.InString(v) {
+			e := &encodeWriter{ResponseWriter: w, enc: Encoding(r.Header)}
+			defer func() { _ = e.close() }()
 			w.Header().Add("Vary", "Accept-Encoding")
-			w.Header().Set("Content-Encoding", "gzip")
+			w = e
 		}
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// Encoding returns encoding of response accepted by request (gzip by default)
+func Encoding(h http.Header) string {
+	if zstdutil.InString(h.Get("Accept-Encoding")) {
+		return "zstd"
+	}
+	return "gzip"
+}
+
+// encodeWriter compresses response by enc unless handler has set
+// Content-Encoding, compressor is taken from pool on first write
+type encodeWriter struct {
+	http.ResponseWriter
+	enc  string
+	w    io.Writer    // nil if response is written as is
+	put  func() error // puts compressor back to pool
+	init bool
+}
+
+func (e *encodeWriter) start() {
+	if e.init {
+		return
+	}
+	e.init = true
+
+	h := e.Header()
+	if h.Get("Content-Encoding") != "" {
+		return
+	}
+
+	switch e.enc {
+	case "zstd":
+		z, err := zstdutil.GetWriter()
+		if err != nil {
+			return
+		}
+		z.Reset(e.ResponseWriter)
+		e.w, e.put = z, func() error { return zstdutil.PutWriter(z) }
+	case "gzip":
+		z, err := gziputil.GetWriter()
+		if err != nil {
+			return
+		}
+		z.Reset(e.ResponseWriter)
+		e.w, e.put = z, func() error { return gziputil.PutWriter(z) }
+	default:
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", e.enc)
+}
+
+func (e *encodeWriter) WriteHeader(code int) {
+	e.start()
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *encodeWriter) Write(b []byte) (int, error) {
+	if !e.init && e.Header().Get("Content-Type") == "" {
+		e.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	e.start()
+
+	if e.w == nil {
+		return e.ResponseWriter.Write(b)
+	}
+	return e.w.Write(b)
+}
+
+func (e *encodeWriter) Flush() {
+	type flusher interface {
+		Flush() error
+	}
+	if f, ok := e.w.(flusher); ok {
+		_ = f.Flush()
+	}
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (e *encodeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return e.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// close flushes compressor and puts it back to pool
+func (e *encodeWriter) close() error {
+	if e.put == nil {
+		return nil
+	}
+	return e.put()
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"internal/compress/gziputil"
+	"internal/compress/zstdutil"
 )
 
 func Meta(next http.Handler) http.Handler {
@@ -72,7 +73,7 @@ func injectMeta(ctx context.Context, h http.Header) error {
 }
 
 func checkHeader(h http.Header) error {
-	err := mustHeaderGzip(h)
+	err := mustHeaderEncoding(h)
 	if err != nil {
 		return err
 	}
@@ -91,9 +92,10 @@ func checkHeader(h http.Header) error {
 
 }
 
-func mustHeaderGzip(h http.Header) error {
-	if !gziputil.InString(h.Get("Content-Encoding")) {
-		return fmt.Errorf("pipe: content-encoding must contain gzip")
+func mustHeaderEncoding(h http.Header) error {
+	v := h.Get("Content-Encoding")
+	if !gziputil.InString(v) && !zstdutil.InString(v) {
+		return fmt.Errorf("pipe: content-encoding must contain gzip or zstd")
 	}
 	return nil
 }
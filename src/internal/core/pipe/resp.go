@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"runtime"
+	"strings"
 
 	"internal/core/pref"
 )
@@ -37,8 +38,10 @@ func writeResp(w http.ResponseWriter, uuid string, code int, data interface{}) (
 	var out []byte
 	var err error
 	// FIXME
+	ctype := w.Header().Get("Content-Type")
+	text := strings.HasPrefix(ctype, "text/") // raw text (csv) is passed as is
 	if data != nil {
-		if w.Header().Get("Content-Type") == "gzip" {
+		if ctype == "gzip" || text {
 			var ok bool
 			if out, ok = data.([]byte); !ok {
 				return 0, fmt.Errorf("unknown data")
@@ -56,7 +59,9 @@ func writeResp(w http.ResponseWriter, uuid string, code int, data interface{}) (
 	}
 
 	w.Header().Set("Connection", "close") // ?
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !text {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
 	w.Header().Set("X-Powered-By", fmt.Sprintf("go version %s", runtime.Version()))
 	w.Header().Set("X-Request-ID", uuid)
 	w.WriteHeader(code)
@@ -6,6 +6,12 @@ import (
 	"net/http"
 )
 
+// Headers are set for handlers with access to request headers
+const (
+	HeaderUUID = "X-Request-ID"
+	HeaderAuth = "X-Request-Auth"
+)
+
 func Wrap(v interface{}) handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -21,7 +27,7 @@ func Wrap(v interface{}) handler {
 			var res interface{}
 			var buf = new(bytes.Buffer)
 			var n int64
-			if r.Method == "POST" {
+			if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
 				n, err = io.Copy(buf, r.Body)
 				if err != nil {
 					goto exit
@@ -34,6 +40,8 @@ func Wrap(v interface{}) handler {
 				h(w, r) // stdh
 				ctx = r.Context()
 			case func([]byte, http.Header, http.Header) (interface{}, error):
+				r.Header.Set(HeaderUUID, uuidFrom(ctx))
+				r.Header.Set(HeaderAuth, authFrom(ctx))
 				res, err = h(buf.Bytes(), r.Header, w.Header())
 			case func([]byte) (interface{}, error):
 				res, err = h(buf.Bytes())
@@ -11,6 +11,8 @@ import (
 	"github.com/sasbury/mini"
 )
 
+var confFile string
+
 func init0(p ...pref) {
 	// see above
 }
@@ -28,6 +30,7 @@ func init2(p ...pref) {
 	if err != nil {
 		return
 	}
+	confFile = os.Args[1]
 
 	for i := range p {
 		setFromConfig(p[i], cfg)
@@ -63,6 +66,8 @@ func setFromConfig(p pref, cfg *mini.Config) {
 		*x = cfg.String(p.name, *x)
 	case *bool:
 		*x = cfg.Boolean(p.name, *x)
+	case *int:
+		*x = int(cfg.Integer(p.name, int64(*x)))
 	default:
 		panic("pref: unreachable: config")
 	}
@@ -83,6 +88,12 @@ func setFromEvar(p pref) {
 			return
 		}
 		*x = b
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return
+		}
+		*x = n
 	default:
 		panic("pref: unreachable: evar")
 	}
@@ -94,6 +105,8 @@ func setFromFlag(p pref) {
 		flag.StringVar(x, p.name, *x, p.usage)
 	case *bool:
 		flag.BoolVar(x, p.name, *x, p.usage)
+	case *int:
+		flag.IntVar(x, p.name, *x, p.usage)
 	default:
 		panic("pref: unreachable: flag")
 	}
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"internal/core/pref"
 	"internal/database/minio"
 	"internal/strings/strutil"
 
@@ -63,9 +64,9 @@ func proc(data []byte) {
 	}
 
 	if m.Fail == "" {
-		log.Println("-->", p.Object, m.Proc)
+		log.Println("-->", shortName(p.Object), m.Proc)
 	} else {
-		log.Println("-x-", p.Object, "err:", m.Fail)
+		log.Println("-x-", shortName(p.Object), "err:", m.Fail)
 	}
 
 }
@@ -208,13 +209,24 @@ func mineLinks(v interface{}, m *meta) (interface{}, error) {
 	}
 	m.Auth = a[0]
 
-	l, err := getLinkAddr([]string{strToSHA1(makeMagicHead(m.Name, m.Head, m.Addr))})
+	e, err := getEffects()
 	if err != nil {
 		return nil, err
 	}
-	m.Link = l[0]
 
-	n := 0
+	err = mineHome(m)
+	if err != nil {
+		return nil, err
+	}
+	day := spanDay(m)
+	h := []linkAddr{m.Link}
+	err = spanAddrs(h, []string{h[0].ID}, day)
+	if err != nil {
+		return nil, err
+	}
+	m.Link = e.blockAddr(h[0], h[0].ID)
+
+	n, u := 0, 0
 	if r, ok := v.(ruler); ok {
 		n = r.len()
 		m.Proc = fmt.Sprintf("%d", n)
@@ -224,7 +236,8 @@ func mineLinks(v interface{}, m *meta) (interface{}, error) {
 	}
 
 	if d, ok := v.(druger); ok {
-		n, err = mineDrugs(d, t)
+		n, u, err = mineDrugs(d, t, m.Auth.ID, day, e)
+		m.setDupe("drug", d.len(), u)
 	}
 	if err != nil {
 		return nil, err
@@ -233,7 +246,8 @@ func mineLinks(v interface{}, m *meta) (interface{}, error) {
 
 	if isSaleIn(t) || isRcgnAddr(t) {
 		if a, ok := v.(addrer); ok {
-			n, err = mineAddrs(a)
+			n, u, err = mineAddrs(a, day, e)
+			m.setDupe("addr", a.len(), u)
 		}
 		if err != nil {
 			return nil, err
@@ -242,35 +256,104 @@ func mineLinks(v interface{}, m *meta) (interface{}, error) {
 	}
 	m.Proc = fmt.Sprintf("%s:%s", m.Proc, time.Since(s).String())
 
+	v = e.dropRows(v, m.Link)
+	if len(e.count) != 0 {
+		m.Stat = e.count
+	}
+
 	return v, nil
 }
 
-func mineDrugs(v druger, t string) (int, error) {
+// mineDrugs links rows and returns number of linked rows and unique names
+func mineDrugs(v druger, t, auth, day string, e *statEffects) (int, int, error) {
 	var (
-		ext  = filepath.Ext(t)
-		keys = make([]string, v.len())
-		name string
+		ext   = filepath.Ext(t)
+		barc  = make([]string, v.len())
+		codes = make([]string, v.len())
+		keys  = make([]string, v.len())
+		norm  = make([]string, v.len())
+		todo  = make([]int, v.len())
+		show  = pref.ParseNames || isRcgnDrug(v)
 	)
 	for i := 0; i < v.len(); i++ {
-		name = v.getName(i)
-		switch {
-		case isUA(ext):
-			name = makeMagicDrugUA(name)
-		case isRU(ext):
-			name = makeMagicDrugRU(name)
-		case isKZ(ext):
-			name = makeMagicDrugKZ(name)
-		case isBY(ext):
-			name = makeMagicDrugBY(name)
-		default:
-			name = makeMagicDrug(name)
+		barc[i] = normGTIN(v.getBarcode(i))
+		codes[i] = v.getCode(i)
+		keys[i] = strToSHA1(makeMagicDrugExt(v.getName(i), ext))
+		todo[i] = i
+
+		p := parseDrugName(v.getName(i))
+		if c := p.canon(); c != "" {
+			norm[i] = strToSHA1(makeMagicDrugExt(c, ext))
+		}
+		if show {
+			v.setParsed(i, p)
 		}
-		keys[i] = strToSHA1(name)
 	}
 
-	lds, err := getLinkDrug(keys)
+	ids, err := getXwlkDrug(auth, codes)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	// barcode first, then crosswalk, then name, then other notation of the name
+	lds := make([]linkDrug, v.len())
+	todo, err = mineDrugsBy(lds, todo, barc, getLinkBarc, matchBarc)
+	if err != nil {
+		return 0, 0, err
+	}
+	todo, err = mineDrugsBy(lds, todo, ids, getLinkDrugCache, matchXwlk)
+	if err != nil {
+		return 0, 0, err
+	}
+	todo, err = mineDrugsBy(lds, todo, keys, getLinkDrugCache, matchName)
+	if err != nil {
+		return 0, 0, err
+	}
+	todo, err = mineDrugsBy(lds, todo, norm, getLinkNorm, matchNorm)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, i := range todo {
+		lds[i] = linkDrug{ID: keys[i]}
+	}
+
+	// versions of links valid for the upload span
+	err = spanDrugs(lds, keys, day)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// blocked links count as unmatched, rows with them teach nothing
+	for i := range lds {
+		lds[i] = e.blockDrug(lds[i], keys[i])
+	}
+
+	// teach crosswalk by rows linked by name (codes which are not known)
+	var learn, look []string
+	for i := 0; i < v.len(); i++ {
+		if codes[i] != "" && lds[i].Match == matchName && ids[i] == "" {
+			learn = append(learn, codes[i])
+			look = append(look, keys[i])
+		}
+	}
+
+	err = putXwlkDrug(auth, learn, look)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// teach notation index by rows linked by name (not by /recognize queries)
+	learn, look = learn[:0], look[:0]
+	for i := 0; i < v.len() && !isRcgnDrug(v); i++ {
+		if norm[i] != "" && lds[i].Match == matchName {
+			learn = append(learn, norm[i])
+			look = append(look, keys[i])
+		}
+	}
+
+	err = putNormDrug(learn, look)
+	if err != nil {
+		return 0, 0, err
 	}
 
 	n := 0
@@ -280,18 +363,115 @@ func mineDrugs(v druger, t string) (int, error) {
 		}
 	}
 
-	return n, nil
+	u, _ := uniqKeys(keys)
+
+	return n, len(u), nil
+}
+
+// mineDrugsBy looks up rows from todo by non-empty keys, sets found links
+// with match method and returns rows which are still not linked
+func mineDrugsBy(lds []linkDrug, todo []int, keys []string, get func([]string) ([]linkDrug, error), match string) ([]int, error) {
+	var (
+		rows []int
+		look []string
+		miss = todo[:0:0]
+	)
+	for _, i := range todo {
+		if keys[i] == "" {
+			miss = append(miss, i)
+			continue
+		}
+		rows = append(rows, i)
+		look = append(look, keys[i])
+	}
+
+	if len(look) == 0 {
+		return miss, nil
+	}
+
+	uniq, idx := uniqKeys(look)
+	l, err := get(uniq)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range rows {
+		k := idx[j]
+		if l[k].IDLink == 0 {
+			miss = append(miss, i)
+			continue
+		}
+		lds[i] = l[k]
+		lds[i].Match = match
+	}
+
+	return miss, nil
 }
 
-func mineAddrs(v addrer) (int, error) {
-	var keys = make([]string, v.len())
+// mineAddrs links rows and returns number of linked rows and unique suppliers
+func mineAddrs(v addrer, day string, e *statEffects) (int, int, error) {
+	var (
+		codes = make([]string, v.len())
+		keys  = make([]string, v.len())
+		norm  = make([]string, v.len())
+		todo  = make([]int, v.len())
+	)
 	for i := 0; i < v.len(); i++ {
+		codes[i] = v.getSuppCode(i)
 		keys[i] = strToSHA1(makeMagicAddr(v.getSupp(i)))
+		if m := v.normSupp(i); m != "" {
+			norm[i] = strToSHA1(m)
+		}
+		todo[i] = i
 	}
 
-	lds, err := getLinkAddr(keys)
+	ids, err := getCodeAddr(codes)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	// code first, then name, then other notation of the address
+	lds := make([]linkAddr, v.len())
+	todo, err = mineAddrsBy(lds, todo, ids, getLinkAddrCache, matchCode)
+	if err != nil {
+		return 0, 0, err
+	}
+	todo, err = mineAddrsBy(lds, todo, keys, getLinkAddrCache, matchName)
+	if err != nil {
+		return 0, 0, err
+	}
+	todo, err = mineAddrsBy(lds, todo, norm, getLinkNadr, matchNorm)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, i := range todo {
+		lds[i] = linkAddr{ID: keys[i]}
+	}
+
+	// versions of links valid for the upload span
+	err = spanAddrs(lds, keys, day)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// blocked links count as unmatched, rows with them teach nothing
+	for i := range lds {
+		lds[i] = e.blockAddr(lds[i], keys[i])
+	}
+
+	// teach address index by rows linked by name (not by /recognize queries)
+	var learn, look []string
+	_, rcgn := v.(jsonRcgnAddr)
+	for i := 0; i < v.len() && !rcgn; i++ {
+		if norm[i] != "" && lds[i].Match == matchName {
+			learn = append(learn, norm[i])
+			look = append(look, keys[i])
+		}
+	}
+
+	err = putNadrAddr(learn, look)
+	if err != nil {
+		return 0, 0, err
 	}
 
 	n := 0
@@ -301,7 +481,82 @@ func mineAddrs(v addrer) (int, error) {
 		}
 	}
 
-	return n, nil
+	u, _ := uniqKeys(keys)
+
+	return n, len(u), nil
+}
+
+// mineAddrsBy is the same as mineDrugsBy for addr links
+func mineAddrsBy(lds []linkAddr, todo []int, keys []string, get func([]string) ([]linkAddr, error), match string) ([]int, error) {
+	var (
+		rows []int
+		look []string
+		miss = todo[:0:0]
+	)
+	for _, i := range todo {
+		if keys[i] == "" {
+			miss = append(miss, i)
+			continue
+		}
+		rows = append(rows, i)
+		look = append(look, keys[i])
+	}
+
+	if len(look) == 0 {
+		return miss, nil
+	}
+
+	uniq, idx := uniqKeys(look)
+	l, err := get(uniq)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range rows {
+		k := idx[j]
+		if l[k].IDLink == 0 {
+			miss = append(miss, i)
+			continue
+		}
+		lds[i] = l[k]
+		lds[i].Match = match
+	}
+
+	return miss, nil
+}
+
+// mineHome links pharmacy of the upload by name and address,
+// geo pharmacies fall back to normalized address
+func mineHome(m *meta) error {
+	var (
+		keys = []string{strToSHA1(makeMagicHead(m.Name, m.Head, m.Addr))}
+		norm = []string{""}
+		lds  = make([]linkAddr, 1)
+	)
+	if isGeo(m.HTag) {
+		if n, _ := makeMagicNorm(m.Name, m.Head, m.Addr); n != "" {
+			norm[0] = strToSHA1(n)
+		}
+	}
+
+	todo, err := mineAddrsBy(lds, []int{0}, keys, getLinkAddrCache, matchName)
+	if err != nil {
+		return err
+	}
+	todo, err = mineAddrsBy(lds, todo, norm, getLinkNadr, matchNorm)
+	if err != nil {
+		return err
+	}
+	if len(todo) > 0 {
+		lds[0] = linkAddr{ID: keys[0]}
+	}
+	m.Link = lds[0]
+
+	if norm[0] != "" && m.Link.Match == matchName {
+		return putNadrAddr(norm, keys)
+	}
+
+	return nil
 }
 
 const (
@@ -352,6 +607,21 @@ func makeMagicDrug(name string) string {
 	)
 }
 
+func makeMagicDrugExt(name, ext string) string {
+	switch {
+	case isUA(ext):
+		return makeMagicDrugUA(name)
+	case isRU(ext):
+		return makeMagicDrugRU(name)
+	case isKZ(ext):
+		return makeMagicDrugKZ(name)
+	case isBY(ext):
+		return makeMagicDrugBY(name)
+	default:
+		return makeMagicDrug(name)
+	}
+}
+
 func makeMagicDrugBY(name string) string {
 	return makeMagicDrug(name) + magicSuffixBY
 }
@@ -384,6 +654,12 @@ func isRcgnAddr(s string) bool {
 	return strings.Contains(s, "rcgn.addr")
 }
 
+// isRcgnDrug returns true for /recognize requests (parsed names are always shown)
+func isRcgnDrug(v druger) bool {
+	_, ok := v.(jsonRcgnDrug)
+	return ok
+}
+
 const (
 	extBY = ".by"
 	extKZ = ".kz"
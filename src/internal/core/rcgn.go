@@ -20,7 +20,7 @@ func Rcgn(meta, data []byte) (interface{}, error) {
 		return nil, err
 	}
 
-	d, err := mineLinks(v, m)
+	d, err := mineRcgn(v, m)
 	if err != nil {
 		return nil, err
 	}
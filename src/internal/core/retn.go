@@ -0,0 +1,392 @@
+package core
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"internal/database/minio"
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:retention"
+// HSET key bucket[/family]->rule (JSON)
+// JSON array: [{"id":"stream-out/geoapt","max_hours":72,"max_count":1000,"archive":true}]
+// Rules of htag family (first part of htag: geoapt, sale-in, sale-out, rcgn)
+// take precedence over rule of bucket. Objects older than max_hours and
+// objects beyond max_count newest ones of the bucket and family are
+// removed by the enforcer (moved to archive if archive is set), which runs
+// on one instance at a time (lock "retention", see takeLock).
+// Bucket rcgn-out has default rule (job results expire with jobs).
+// Removed and moved objects are counted by expvar (/debug/vars, "m12.retention").
+const (
+	dictRetn = "retention"
+
+	retnTick    = 10 * time.Minute
+	retnLockTTL = time.Minute
+)
+
+var (
+	listRetn = map[string]struct{}{
+		bucketStreamOut:     {},
+		bucketStreamOutGeo:  {},
+		bucketStreamOutFrwd: {},
+		bucketStreamErr:     {},
+		bucketRcgnOut:       {},
+	}
+
+	// defaultRetn are rules of buckets without rule set
+	defaultRetn = map[string]itemRetn{
+		bucketRcgnOut: {ID: bucketRcgnOut, MaxHours: jobTTL / 3600}, // results outlive jobs
+	}
+
+	retnVars = expvar.NewMap("m12.retention")
+
+	retnLast struct {
+		sync.Mutex
+		stat *retnStat
+	}
+)
+
+type itemRetn struct {
+	ID       string `json:"id,omitempty"`
+	MaxHours int64  `json:"max_hours,omitempty"`
+	MaxCount int    `json:"max_count,omitempty"`
+	Archive  bool   `json:"archive,omitempty"`
+}
+
+type retnStat struct {
+	Time    string           `json:"time,omitempty"`
+	Proc    string           `json:"proc,omitempty"`
+	Dry     bool             `json:"dry,omitempty"`
+	Keys    map[string]int64 `json:"keys,omitempty"`    // scanned objects per bucket
+	Removed map[string]int64 `json:"removed,omitempty"` // removed objects per bucket
+	Moved   map[string]int64 `json:"moved,omitempty"`   // moved to archive per bucket
+	List    []string         `json:"list,omitempty"`    // first removed objects (bucket/object)
+	Fail    string           `json:"fail,omitempty"`
+}
+
+type retnObject struct {
+	name string
+	time time.Time
+}
+
+type retnByTime []retnObject
+
+func (r retnByTime) Len() int           { return len(r) }
+func (r retnByTime) Less(i, j int) bool { return r[i].time.After(r[j].time) }
+func (r retnByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func keyRetn() string {
+	return makeKey(nsHset, dictRetn)
+}
+
+// htagFamily returns first part of htag (sale-out.daily.ua -> sale-out)
+func htagFamily(t string) string {
+	return strings.SplitN(normHTag(t), ".", 2)[0]
+}
+
+func testRetn(r itemRetn) error {
+	b := strings.SplitN(r.ID, "/", 2)[0]
+	if _, ok := listRetn[b]; !ok {
+		return fmt.Errorf("core: invalid retention bucket %s", r.ID)
+	}
+	if r.MaxHours < 0 || r.MaxCount < 0 || r.MaxHours == 0 && r.MaxCount == 0 {
+		return fmt.Errorf("core: invalid retention rule %s", r.ID)
+	}
+	return nil
+}
+
+func getRetns() (map[string]itemRetn, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	r, err := redis.StringMap(c.Do("HGETALL", keyRetn()))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]itemRetn, len(r))
+	for k, v := range r {
+		i := itemRetn{}
+		err = json.Unmarshal([]byte(v), &i)
+		if err != nil {
+			return nil, err
+		}
+		i.ID = k
+		out[k] = i
+	}
+
+	for k, v := range defaultRetn {
+		if _, ok := out[k]; !ok {
+			out[k] = v
+		}
+	}
+
+	return out, nil
+}
+
+// GetRetn returns retention rules (all if empty).
+// JSON array: ["stream-out","stream-out/geoapt"]
+func GetRetn(data []byte) (interface{}, error) {
+	var v []string
+	if len(data) > 0 {
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := getRetns()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v) == 0 {
+		for k := range r {
+			v = append(v, k)
+		}
+		sort.Strings(v)
+	}
+
+	out := make([]itemRetn, 0, len(v))
+	for i := range v {
+		if x, ok := r[v[i]]; ok {
+			out = append(out, x)
+		}
+	}
+
+	return out, nil
+}
+
+// SetRetn sets retention rules.
+// JSON array: [{"id":"stream-out/geoapt","max_hours":72,"max_count":1000,"archive":true}]
+func SetRetn(data []byte, auth, uuid string) (interface{}, error) {
+	var v []itemRetn
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: dictRetn,
+		keys: make([]string, len(v)),
+		vals: make([]map[string]string, len(v)),
+	}
+	for i := range v {
+		err = testRetn(v[i])
+		if err != nil {
+			return nil, err
+		}
+		w.keys[i] = v[i].ID
+		v[i].ID = ""
+		b, _ := json.Marshal(v[i])
+		w.vals[i] = nameHash(string(b))
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
+
+// DelRetn deletes retention rules.
+// JSON array: ["stream-out","stream-out/geoapt"]
+func DelRetn(data []byte, auth, uuid string) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(&dictWrite{dict: dictRetn, keys: v}, actor{auth, uuid})
+}
+
+// GetRetnStat returns report of the last scheduled run of the enforcer
+func GetRetnStat() (interface{}, error) {
+	retnLast.Lock()
+	defer retnLast.Unlock()
+
+	if retnLast.stat == nil {
+		return retnStat{}, nil
+	}
+	return retnLast.stat, nil
+}
+
+// Enforce applies retention rules now and returns report.
+// JSON object: {"dry":true} (report only)
+func Enforce(data []byte) (interface{}, error) {
+	v := struct {
+		Dry bool `json:"dry,omitempty"`
+	}{}
+	if len(data) > 0 {
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return enforceRetn(v.Dry)
+}
+
+func trimRetn(d time.Duration) {
+	_ = time.AfterFunc(d, func() {
+		defer trimRetn(d)
+
+		s, err := enforceRetn(false)
+		if err == errRetnBusy {
+			return // run of another instance
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+		retnLast.Lock()
+		retnLast.stat = s
+		retnLast.Unlock()
+	})
+}
+
+var errRetnBusy = fmt.Errorf("core: retention is enforced by another instance")
+
+func enforceRetn(dry bool) (*retnStat, error) {
+	if !dry {
+		l, err := takeLock(retnLockTTL, dictRetn)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			return nil, errRetnBusy
+		}
+		defer func() {
+			err := l.release()
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	t := time.Now()
+	s := &retnStat{
+		Time:    t.String(),
+		Dry:     dry,
+		Keys:    make(map[string]int64),
+		Removed: make(map[string]int64),
+		Moved:   make(map[string]int64),
+	}
+
+	r, err := getRetns()
+	if err != nil {
+		s.Fail = err.Error()
+		return s, err
+	}
+
+	var b []string
+	for k := range r {
+		k = strings.SplitN(k, "/", 2)[0]
+		if _, ok := s.Keys[k]; !ok {
+			s.Keys[k] = 0
+			b = append(b, k)
+		}
+	}
+	sort.Strings(b)
+
+	for i := range b {
+		err = enforceBucket(s, b[i], r, t)
+		if err != nil {
+			s.Fail = err.Error()
+			break
+		}
+	}
+
+	s.Proc = time.Since(t).String()
+	return s, err
+}
+
+// enforceBucket groups all objects of bucket by rules and removes expired
+// ones (newest first by time of last modification)
+func enforceBucket(s *retnStat, b string, r map[string]itemRetn, now time.Time) error {
+	group := make(map[string][]retnObject)
+	var err error
+	werr := minio.Walk(b, "", func(o string) bool {
+		s.Keys[b]++
+
+		k := b + "/" + htagFamily(objectHTag(o))
+		if _, ok := r[k]; !ok {
+			k = b
+		}
+		if _, ok := r[k]; !ok {
+			return true
+		}
+
+		var t time.Time
+		t, err = minio.Stat(b, o)
+		if err != nil {
+			return false
+		}
+		group[k] = append(group[k], retnObject{o, t})
+		return true
+	})
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+
+	for k, v := range group {
+		sort.Sort(retnByTime(v))
+		for i := range v {
+			if !r[k].expired(i, v[i].time, now) {
+				continue
+			}
+			err = s.remove(b, v[i], r[k].Archive)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// expired returns true for object of i-th newest position and time t
+func (r itemRetn) expired(i int, t, now time.Time) bool {
+	return r.MaxCount > 0 && i >= r.MaxCount ||
+		r.MaxHours > 0 && now.Sub(t) > time.Duration(r.MaxHours)*time.Hour
+}
+
+func (s *retnStat) remove(b string, o retnObject, arch bool) error {
+	if len(s.List) < checkLimit {
+		s.List = append(s.List, b+"/"+o.name)
+	}
+	if arch {
+		s.Moved[b]++
+	} else {
+		s.Removed[b]++
+	}
+	if s.Dry {
+		return nil
+	}
+
+	if arch {
+		err := minio.Copy(bucketArchive, retnArchName(b, o), b, o.name)
+		if err != nil {
+			return err
+		}
+		retnVars.Add(b+".moved", 1)
+	} else {
+		retnVars.Add(b+".removed", 1)
+	}
+
+	return minio.Del(b, o.name)
+}
+
+// retnArchName returns archive name of object of bucket (auth part is of _<bucket>)
+func retnArchName(b string, o retnObject) string {
+	return fmt.Sprintf("%s/%s/%s/%s",
+		o.time.UTC().Format(archDay), authPart("_"+b), namePart(objectHTag(o.name)), namePart(baseName(o.name)))
+}
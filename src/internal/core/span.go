@@ -0,0 +1,399 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:span:<dict>:<key>" (dict is drug or addr)
+// HMSET key n->versions (JSON array sorted by valid_from) v->counter of writes
+// JSON object: {"dict":"drug","list":[{"id":"key1","valid_from":"2017-01-01","valid_to":"2017-06-30","id_link":1,"id_drug":2}]}
+// Versions of links override current link of the key when upload span
+// (its lower bound) is inside [valid_from, valid_to], empty bound is open.
+const (
+	nsSpan = "span"
+
+	dictSpanDrug = nsSpan + ":" + nsDrug
+	dictSpanAddr = nsSpan + ":" + nsAddr
+
+	spanLayout = "2006-01-02"
+	spanOpen   = "9999-12-31"
+)
+
+var listSpans = map[string]string{
+	"drug": dictSpanDrug,
+	"addr": dictSpanAddr,
+}
+
+// spanLayouts are layouts of upload span (see testDateTimeSpan)
+var spanLayouts = []string{
+	"02.01.2006 15:04:05",
+	"02.01.2006",
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	spanLayout,
+}
+
+type itemSpan struct {
+	ID     string `json:"id,omitempty"`
+	From   string `json:"valid_from,omitempty"`
+	To     string `json:"valid_to,omitempty"`
+	IDLink int64  `json:"id_link,omitempty"`
+	IDDrug int64  `json:"id_drug,omitempty"`
+	IDBrnd int64  `json:"id_brnd,omitempty"`
+	IDCatg int64  `json:"id_catg,omitempty"`
+	IDAddr int64  `json:"id_addr,omitempty"`
+	IDOrgn int64  `json:"id_orgn,omitempty"`
+	IDStat int64  `json:"id_stat,omitempty"`
+	EGRPOU string `json:"egrpou,omitempty"`
+}
+
+type spanQuery struct {
+	Dict string     `json:"dict"`
+	IDs  []string   `json:"ids,omitempty"`
+	List []itemSpan `json:"list,omitempty"`
+}
+
+type spansByFrom []itemSpan
+
+func (s spansByFrom) Len() int           { return len(s) }
+func (s spansByFrom) Less(i, j int) bool { return s[i].From < s[j].From }
+func (s spansByFrom) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func keySpan(dict, key string) string {
+	return makeKey(dict, key)
+}
+
+func (s itemSpan) to() string {
+	if s.To == "" {
+		return spanOpen
+	}
+	return s.To
+}
+
+func (s itemSpan) has(day string) bool {
+	return s.From <= day && day <= s.to()
+}
+
+func (s itemSpan) drug(key string) linkDrug {
+	return linkDrug{
+		ID:     key,
+		IDLink: s.IDLink,
+		IDDrug: s.IDDrug,
+		IDBrnd: s.IDBrnd,
+		IDCatg: s.IDCatg,
+		IDStat: s.IDStat,
+	}
+}
+
+func (s itemSpan) addr(key string) linkAddr {
+	return linkAddr{
+		ID:     key,
+		IDLink: s.IDLink,
+		IDAddr: s.IDAddr,
+		IDOrgn: s.IDOrgn,
+		IDStat: s.IDStat,
+		EGRPOU: s.EGRPOU,
+	}
+}
+
+func testSpan(s itemSpan) error {
+	for _, d := range []string{s.From, s.To} {
+		if d == "" {
+			continue
+		}
+		_, err := time.Parse(spanLayout, d)
+		if err != nil {
+			return fmt.Errorf("core: invalid span date %s", d)
+		}
+	}
+	if s.ID == "" || s.From > s.to() {
+		return fmt.Errorf("core: invalid span %s [%s, %s]", s.ID, s.From, s.To)
+	}
+	return nil
+}
+
+// spanDay returns day of lower bound of upload span ("" if unknown)
+func spanDay(m *meta) string {
+	if len(m.Span) == 0 {
+		return ""
+	}
+	for _, l := range spanLayouts {
+		t, err := time.Parse(l, m.Span[0])
+		if err == nil {
+			return t.Format(spanLayout)
+		}
+	}
+	return ""
+}
+
+func parseSpanQuery(data []byte) (spanQuery, error) {
+	q := spanQuery{}
+	err := json.Unmarshal(data, &q)
+	if err != nil {
+		return q, err
+	}
+
+	d, ok := listSpans[q.Dict]
+	if !ok {
+		return q, fmt.Errorf("core: invalid dict %s", q.Dict)
+	}
+	q.Dict = d
+
+	return q, nil
+}
+
+// readSpans returns versions of keys of dict and counters of their writes
+// (for compare-and-set)
+func readSpans(dict string, keys []string) ([][]itemSpan, []int64, error) {
+	r, err := readDict(dict, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make([][]itemSpan, len(keys))
+	vers := make([]int64, len(keys))
+	for i := range keys {
+		vers[i], _ = strconv.ParseInt(r[i][fldVers], 10, 64)
+		if r[i][fldName] == "" {
+			continue
+		}
+		err = json.Unmarshal([]byte(r[i][fldName]), &out[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return out, vers, nil
+}
+
+// findSpans returns version valid for day of each key (nil if none)
+func findSpans(dict string, keys []string, day string) ([]*itemSpan, error) {
+	out := make([]*itemSpan, len(keys))
+	if day == "" || len(keys) == 0 {
+		return out, nil
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	uniq, idx := uniqKeys(keys)
+	vers := make([]*itemSpan, len(uniq))
+	for p := 0; p < len(uniq); p += lookChunk {
+		q := lookEnd(p, len(uniq))
+		for i := p; i < q; i++ {
+			err := c.Send("HGET", keySpan(dict, uniq[i]), fldName)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := c.Flush()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := p; i < q; i++ {
+			r, err := redis.String(c.Receive())
+			if err != nil && redis.NotErrNil(err) {
+				return nil, err
+			}
+			if r == "" {
+				continue
+			}
+			var s []itemSpan
+			err = json.Unmarshal([]byte(r), &s)
+			if err != nil {
+				return nil, err
+			}
+			for j := len(s) - 1; j >= 0; j-- {
+				if s[j].has(day) {
+					vers[i] = &s[j]
+					break
+				}
+			}
+		}
+	}
+
+	for i := range keys {
+		out[i] = vers[idx[i]]
+	}
+
+	return out, nil
+}
+
+// spanDrugs replaces links by their versions valid for day, versions are
+// looked up by keys of names (link of row found by barcode or code has other ID)
+func spanDrugs(lds []linkDrug, keys []string, day string) error {
+	s, err := findSpans(dictSpanDrug, keys, day)
+	if err != nil {
+		return err
+	}
+
+	for i := range lds {
+		if s[i] != nil {
+			m := lds[i].Match
+			lds[i] = s[i].drug(lds[i].ID)
+			lds[i].Match = m
+		}
+	}
+
+	return nil
+}
+
+// spanAddrs replaces links by their versions valid for day, versions are
+// looked up by keys of names (link of row found by barcode or code has other ID)
+func spanAddrs(lds []linkAddr, keys []string, day string) error {
+	s, err := findSpans(dictSpanAddr, keys, day)
+	if err != nil {
+		return err
+	}
+
+	for i := range lds {
+		if s[i] != nil {
+			m := lds[i].Match
+			lds[i] = s[i].addr(lds[i].ID)
+			lds[i].Match = m
+		}
+	}
+
+	return nil
+}
+
+// GetSpan returns versions of links.
+// JSON object: {"dict":"drug","ids":["key1","key2"]}
+func GetSpan(data []byte) (interface{}, error) {
+	q, err := parseSpanQuery(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r, _, err := readSpans(q.Dict, q.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []itemSpan{}
+	for i := range q.IDs {
+		for _, s := range r[i] {
+			s.ID = q.IDs[i]
+			out = append(out, s)
+		}
+	}
+
+	return out, nil
+}
+
+// SetSpan adds versions of links (version with the same valid_from is replaced).
+// JSON object: {"dict":"drug","list":[{"id":"key1","valid_from":"2017-01-01","valid_to":"2017-06-30","id_link":1}]}
+func SetSpan(data []byte, auth, uuid string) (interface{}, error) {
+	q, err := parseSpanQuery(data)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(map[string][]itemSpan)
+	for _, s := range q.List {
+		err = testSpan(s)
+		if err != nil {
+			return nil, err
+		}
+		list[s.ID] = append(list[s.ID], s)
+	}
+
+	return statusOK, writeSpans(q.Dict, list, actor{auth, uuid}, func(old []itemSpan, add []itemSpan) ([]itemSpan, error) {
+		for _, s := range add {
+			out := old[:0]
+			for _, o := range old {
+				if o.From == s.From {
+					continue
+				}
+				if o.From <= s.to() && s.From <= o.to() {
+					return nil, fmt.Errorf("core: span %s [%s, %s] overlaps [%s, %s]", s.ID, s.From, s.To, o.From, o.To)
+				}
+				out = append(out, o)
+			}
+			s.ID = ""
+			old = append(out, s)
+		}
+		return old, nil
+	})
+}
+
+// DelSpan deletes versions of links (all versions of a key if valid_from is empty).
+// JSON object: {"dict":"drug","list":[{"id":"key1","valid_from":"2017-01-01"}]}
+func DelSpan(data []byte, auth, uuid string) (interface{}, error) {
+	q, err := parseSpanQuery(data)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(map[string][]itemSpan)
+	for _, s := range q.List {
+		list[s.ID] = append(list[s.ID], s)
+	}
+
+	return statusOK, writeSpans(q.Dict, list, actor{auth, uuid}, func(old []itemSpan, del []itemSpan) ([]itemSpan, error) {
+		for _, s := range del {
+			if s.From == "" {
+				return nil, nil
+			}
+			out := old[:0]
+			for _, o := range old {
+				if o.From != s.From {
+					out = append(out, o)
+				}
+			}
+			old = out
+		}
+		return old, nil
+	})
+}
+
+// writeSpans applies changes to versions of keys, changes are computed
+// again if keys were written by somebody else since they were read
+func writeSpans(dict string, list map[string][]itemSpan, a actor, f func([]itemSpan, []itemSpan) ([]itemSpan, error)) error {
+	keys := make([]string, 0, len(list))
+	for k := range list {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for n := 0; n < casN; n++ {
+		old, vers, err := readSpans(dict, keys)
+		if err != nil {
+			return err
+		}
+
+		vals := make([]map[string]string, len(keys))
+		for i, k := range keys {
+			v, err := f(old[i], list[k])
+			if err != nil {
+				return err
+			}
+			if len(v) == 0 {
+				continue // deletes key
+			}
+			sort.Sort(spansByFrom(v))
+			d, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			vals[i] = nameHash(string(d))
+		}
+
+		err = writeDict(&dictWrite{dict: dict, keys: keys, vals: vals, vers: vers, cas: true}, a)
+		if _, ok := err.(errVers); ok {
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("core: too many concurrent writes, try again")
+}
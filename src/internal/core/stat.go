@@ -0,0 +1,233 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:hset:stat:effect"
+// HSET key i->effects (comma separated)
+// JSON array: [{"id":1,"effect":["block"]}]
+//
+// HASH => key="<prefix>:hset:auth:stat"
+// HSET key auth->i (status ID of auth key)
+// Effects of statuses: block (drug and addr links count as unmatched),
+// drop (rows with the links are dropped from outputs), deny (auth keys
+// are rejected in Pass).
+const (
+	dictStatEffect = "stat:effect"
+	dictAuthStat   = "auth:stat"
+
+	effBlock = "block"
+	effDrop  = "drop"
+	effDeny  = "deny"
+)
+
+var listEffects = map[string]struct{}{
+	effBlock: {},
+	effDrop:  {},
+	effDeny:  {},
+}
+
+type linkEffect struct {
+	ID     int64    `json:"id"`
+	Effect []string `json:"effect,omitempty"`
+}
+
+func keyStatEffect() string {
+	return makeKey(nsHset, dictStatEffect)
+}
+
+func keyAuthStat() string {
+	return makeKey(nsHset, dictAuthStat)
+}
+
+// statEffects holds effects of statuses and counts applied effects
+type statEffects struct {
+	rule  map[int64]map[string]bool
+	count map[string]int64
+}
+
+func getEffects() (*statEffects, error) {
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	r, err := redis.StringMap(c.Do("HGETALL", keyStatEffect()))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &statEffects{
+		rule:  make(map[int64]map[string]bool, len(r)),
+		count: make(map[string]int64),
+	}
+	for k, v := range r {
+		id, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			continue
+		}
+		e.rule[id] = make(map[string]bool)
+		for _, s := range splitDicts(v) {
+			e.rule[id][s] = true
+		}
+	}
+
+	return e, nil
+}
+
+func (e *statEffects) has(stat int64, eff string) bool {
+	return stat != 0 && e.rule[stat][eff]
+}
+
+// blockDrug returns unmatched link if status of the link blocks it
+func (e *statEffects) blockDrug(l linkDrug, key string) linkDrug {
+	if !e.has(l.IDStat, effBlock) {
+		return l
+	}
+	e.count[effBlock]++
+	return linkDrug{ID: key, IDStat: l.IDStat}
+}
+
+// blockAddr returns unmatched link if status of the link blocks it
+func (e *statEffects) blockAddr(l linkAddr, key string) linkAddr {
+	if !e.has(l.IDStat, effBlock) {
+		return l
+	}
+	e.count[effBlock]++
+	return linkAddr{ID: key, IDStat: l.IDStat}
+}
+
+// dropRows removes rows with dropped drug or addr links (all rows if pharmacy of upload is dropped)
+func (e *statEffects) dropRows(v interface{}, home linkAddr) interface{} {
+	all := e.has(home.IDStat, effDrop)
+	drop := func(d, a int64) bool {
+		if all || e.has(d, effDrop) || e.has(a, effDrop) {
+			e.count[effDrop]++
+			return true
+		}
+		return false
+	}
+
+	switch v := v.(type) {
+	case jsonV3Geoa:
+		out := v[:0]
+		for i := range v {
+			if !drop(v[i].Link.IDStat, 0) {
+				out = append(out, v[i])
+			}
+		}
+		return out
+	case jsonV3Sale:
+		out := v[:0]
+		for i := range v {
+			if !drop(v[i].LinkDrug.IDStat, v[i].LinkAddr.IDStat) {
+				out = append(out, v[i])
+			}
+		}
+		return out
+	case jsonV3SaleBy:
+		out := v[:0]
+		for i := range v {
+			if !drop(v[i].Link.IDStat, 0) {
+				out = append(out, v[i])
+			}
+		}
+		return out
+	}
+
+	return v
+}
+
+// passStat returns false if status of auth key denies access
+func passStat(c redis.Connection, key string) (bool, error) {
+	s, err := redis.Int64(c.Do("HGET", keyAuthStat(), key))
+	if err != nil && redis.NotErrNil(err) {
+		return false, err
+	}
+	if s == 0 {
+		return true, nil
+	}
+
+	r, err := redis.String(c.Do("HGET", keyStatEffect(), s))
+	if err != nil && redis.NotErrNil(err) {
+		return false, err
+	}
+	for _, v := range splitDicts(r) {
+		if v == effDeny {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// GetEffect returns effects of statuses.
+// JSON array: [1,2]
+func GetEffect(data []byte) (interface{}, error) {
+	var v []int64
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := readDict(dictStatEffect, formatIDs(v))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]linkEffect, len(v))
+	for i := range v {
+		out[i] = linkEffect{ID: v[i], Effect: splitDicts(r[i][fldName])}
+	}
+
+	return out, nil
+}
+
+// SetEffect sets effects of statuses.
+// JSON array: [{"id":1,"effect":["block","drop"]}]
+func SetEffect(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkEffect
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: dictStatEffect,
+		keys: make([]string, len(v)),
+		vals: make([]map[string]string, len(v)),
+	}
+	for i := range v {
+		for _, s := range v[i].Effect {
+			if _, ok := listEffects[s]; !ok {
+				return nil, fmt.Errorf("core: invalid effect %s", s)
+			}
+		}
+		w.keys[i] = strconv.FormatInt(v[i].ID, 10)
+		w.vals[i] = nameHash(strings.Join(v[i].Effect, ","))
+	}
+
+	err = testNames(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
+
+// DelEffect deletes effects of statuses.
+// JSON array: [1,2]
+func DelEffect(data []byte, auth, uuid string) (interface{}, error) {
+	var v []int64
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(&dictWrite{dict: dictStatEffect, keys: formatIDs(v)}, actor{auth, uuid})
+}
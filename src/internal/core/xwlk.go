@@ -0,0 +1,226 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"internal/database/redis"
+)
+
+// Redis scheme:
+// HASH => key="<prefix>:xwlk:<auth>"
+// HSET key code->ID (SHA1 of drug link)
+// Crosswalk from source internal product codes to drug links per auth ID.
+const (
+	dictXwlk = "xwlk"
+	nsXwlk   = "xwlk"
+
+	// learnActor is author of entries learned from uploads (audit log)
+	learnActor = "learn"
+)
+
+type linkXwlk struct {
+	Auth string   `json:"auth,omitempty"`
+	Code string   `json:"code,omitempty"`
+	ID   string   `json:"id,omitempty"` // drug key (SHA1)
+	Link linkDrug `json:"link,omitempty"`
+}
+
+func keyXwlk(auth string) string {
+	return makeKey(nsXwlk, auth)
+}
+
+// xwlkKey joins auth and code into dictionary key "auth:code"
+func xwlkKey(auth, code string) string {
+	return auth + ":" + code
+}
+
+func splitXwlkKey(key string) (string, string, error) {
+	s := strings.SplitN(key, ":", 2)
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", "", fmt.Errorf("core: invalid crosswalk key %s", key)
+	}
+	return s[0], s[1], nil
+}
+
+// getXwlkDrug returns drug keys by source codes ("" if unknown)
+func getXwlkDrug(auth string, codes []string) ([]string, error) {
+	out := make([]string, len(codes))
+	if auth == "" {
+		return out, nil
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	n := 0
+	var err error
+	for i := range codes {
+		if codes[i] == "" {
+			continue
+		}
+		err = c.Send("HGET", keyXwlk(auth), codes[i])
+		if err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	if n == 0 {
+		return out, nil
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range codes {
+		if codes[i] == "" {
+			continue
+		}
+		out[i], err = redis.String(c.Receive())
+		if err != nil && redis.NotErrNil(err) {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// putXwlkDrug remembers drug keys of successfully linked source codes,
+// entries set by curators are kept and learned ones go to audit log
+func putXwlkDrug(auth string, codes, keys []string) error {
+	if auth == "" || len(codes) == 0 {
+		return nil
+	}
+
+	uniq, idx := uniqKeys(codes)
+	look := make([]string, len(uniq))
+	for i := range codes {
+		if look[idx[i]] == "" {
+			look[idx[i]] = keys[i]
+		}
+	}
+
+	c := redis.Conn()
+	defer redis.Free(c)
+
+	var v []auditItem
+	for p := 0; p < len(uniq); p += lookChunk {
+		q := lookEnd(p, len(uniq))
+		for i := p; i < q; i++ {
+			err := c.Send("HSETNX", keyXwlk(auth), uniq[i], look[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		err := c.Flush()
+		if err != nil {
+			return err
+		}
+
+		for i := p; i < q; i++ {
+			ok, err := redis.Bool(c.Receive())
+			if err != nil {
+				return err
+			}
+			if ok {
+				v = append(v, auditItem{Dict: dictXwlk, Key: xwlkKey(auth, uniq[i]), New: nameHash(look[i])})
+			}
+		}
+	}
+
+	if len(v) == 0 {
+		return nil
+	}
+
+	return putAudit(v, actor{auth: learnActor})
+}
+
+// GetXwlk returns crosswalk entries with current drug links.
+// JSON array: [{"auth":"auth1","code":"code1"}]
+func GetXwlk(data []byte) (interface{}, error) {
+	var v []linkXwlk
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(v))
+	for i := range v {
+		keys[i] = xwlkKey(v[i].Auth, v[i].Code)
+	}
+
+	r, err := readDict(dictXwlk, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range v {
+		v[i].ID = r[i][fldName]
+		keys[i] = v[i].ID
+	}
+
+	l, err := getLinkDrug(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range v {
+		if v[i].ID != "" {
+			v[i].Link = l[i]
+		}
+	}
+
+	return v, nil
+}
+
+// SetXwlk confirms or corrects crosswalk entries.
+// JSON array: [{"auth":"auth1","code":"code1","id":"key1"}]
+func SetXwlk(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkXwlk
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: dictXwlk,
+		keys: make([]string, len(v)),
+		vals: make([]map[string]string, len(v)),
+	}
+	for i := range v {
+		w.keys[i] = xwlkKey(v[i].Auth, v[i].Code)
+		w.vals[i] = nameHash(v[i].ID)
+	}
+
+	err = testNames(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
+
+// DelXwlk deletes crosswalk entries.
+// JSON array: [{"auth":"auth1","code":"code1"}]
+func DelXwlk(data []byte, auth, uuid string) (interface{}, error) {
+	var v []linkXwlk
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dictWrite{
+		dict: dictXwlk,
+		keys: make([]string, len(v)),
+	}
+	for i := range v {
+		w.keys[i] = xwlkKey(v[i].Auth, v[i].Code)
+	}
+
+	return statusOK, writeDict(w, actor{auth, uuid})
+}
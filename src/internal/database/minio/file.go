@@ -0,0 +1,279 @@
+package minio
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileStorage keeps buckets as directories and objects as files of local
+// directory tree (file:///var/lib/m12), names with "/" are subdirectories.
+// Writes go to hidden temp files which are renamed, so readers never see
+// partial objects. Listing is the same as Minio one: names in lexical
+// order, subdirectories as prefixes with trailing "/" (non-recursive) or
+// all objects below prefix (recursive).
+type fileStorage struct {
+	root string
+}
+
+const fileTemp = ".tmp-"
+
+func makeFile(u *url.URL) (*fileStorage, error) {
+	root := filepath.FromSlash(u.Path)
+	if u.Host != "" { // file://./data
+		root = filepath.Join(u.Host, root)
+	}
+	if root == "" {
+		return nil, fmt.Errorf("minio: empty path of %s", u.String())
+	}
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStorage{root}, nil
+}
+
+func testBucket(b string) error {
+	if b == "" || strings.ContainsAny(b, `/\`) || strings.HasPrefix(b, ".") {
+		return fmt.Errorf("minio: invalid bucket %s", b)
+	}
+	return nil
+}
+
+func (s *fileStorage) path(b, o string) (string, error) {
+	err := testBucket(b)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(s.root, b, filepath.FromSlash(o))
+	if o == "" || !strings.HasPrefix(p, filepath.Join(s.root, b)+string(filepath.Separator)) ||
+		strings.HasPrefix(filepath.Base(p), ".") {
+		return "", fmt.Errorf("minio: invalid object %s", o)
+	}
+	return p, nil
+}
+
+func (s *fileStorage) Put(b, o string, r io.Reader) error {
+	p, err := s.path(b, o)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filepath.Join(s.root, b))
+	if err != nil {
+		return err // bucket must exist
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), fileTemp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
+
+func (s *fileStorage) Get(b, o string) (io.ReadCloser, error) {
+	p, err := s.path(b, o)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *fileStorage) Del(b, o string) error {
+	p, err := s.path(b, o)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil // as Minio
+	}
+	if err != nil {
+		return err
+	}
+
+	// remove empty subdirectories left by the object
+	d := filepath.Join(s.root, b)
+	for p = filepath.Dir(p); p != d; p = filepath.Dir(p) {
+		if os.Remove(p) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStorage) Make(b string) error {
+	err := testBucket(b)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(s.root, b), 0755)
+}
+
+func (s *fileStorage) Copy(bDst, oDst, bSrc, oSrc string) error {
+	r, err := s.Get(bSrc, oSrc)
+	if err != nil {
+		return err
+	}
+	defer Free(r)
+
+	return s.Put(bDst, oDst, r)
+}
+
+func (s *fileStorage) Scan(b, prefix string, deep bool, n int) ([]string, error) {
+	err := testBucket(b)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(filepath.Join(s.root, b))
+	if err != nil {
+		return nil, err // bucket must exist
+	}
+
+	// prefix is directory part (up to the last "/") and start of name
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	for _, v := range strings.Split(dir, "/") {
+		if v == "." || v == ".." {
+			return nil, fmt.Errorf("minio: invalid prefix %s", prefix)
+		}
+	}
+
+	var out []string
+	if deep {
+		out, err = s.walk(b, dir, prefix)
+	} else {
+		out, err = s.read(b, dir, prefix)
+	}
+	if os.IsNotExist(err) {
+		return []string{}, nil // as Minio
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(out)
+
+	if len(out) > n {
+		out = out[:n]
+	}
+
+	return out, nil
+}
+
+func (s *fileStorage) Walk(b, prefix string, f func(string) bool) error {
+	l, err := s.Scan(b, prefix, true, int(^uint(0)>>1))
+	if err != nil {
+		return err
+	}
+
+	for i := range l {
+		if !f(l[i]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStorage) Stat(b, o string) (time.Time, error) {
+	p, err := s.path(b, o)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+// read returns names of directory dir with prefix
+func (s *fileStorage) read(b, dir, prefix string) ([]string, error) {
+	f, err := os.Open(filepath.Join(s.root, b, filepath.FromSlash(dir)))
+	if err != nil {
+		return nil, err
+	}
+	defer Free(f)
+
+	l, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(l))
+	for i := range l {
+		name := dir + l[i].Name()
+		if strings.HasPrefix(l[i].Name(), ".") || !strings.HasPrefix(name, prefix) {
+			continue // temp files
+		}
+		if l[i].IsDir() {
+			name += "/"
+		}
+		out = append(out, name)
+	}
+
+	return out, nil
+}
+
+// walk returns names of objects of directory dir and its subdirectories with prefix
+func (s *fileStorage) walk(b, dir, prefix string) ([]string, error) {
+	root := filepath.Join(s.root, b)
+	out := []string{}
+	err := filepath.Walk(filepath.Join(root, filepath.FromSlash(dir)), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil // temp files
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, prefix) {
+			out = append(out, name)
+		}
+		return nil
+	})
+
+	return out, err
+}
@@ -3,28 +3,50 @@ package minio
 import (
 	"io"
 	"net/url"
+	"time"
 
 	minio "github.com/minio/minio-go"
 )
 
-var cli *minio.Client
+// storage is object storage: Minio server or local directory tree
+type storage interface {
+	Put(b, o string, r io.Reader) error
+	Get(b, o string) (io.ReadCloser, error)
+	Del(b, o string) error
+	Make(b string) error
+	Copy(bDst, oDst, bSrc, oSrc string) error
+	Scan(b, prefix string, deep bool, n int) ([]string, error)
+	Walk(b, prefix string, f func(string) bool) error
+	Stat(b, o string) (time.Time, error)
+}
+
+var cli storage
 
-// Init inits client for MINIO Server
+// Init inits client for MINIO Server (or local directory for file:// address)
 func Init(addr string) error {
-	c, err := makeConn(addr)
+	u, err := url.Parse(addr)
 	if err != nil {
 		return err
 	}
-	cli = c
-	return nil
-}
 
-func makeConn(addr string) (*minio.Client, error) {
-	u, err := url.Parse(addr)
+	if u.Scheme == "file" {
+		c, err := makeFile(u)
+		if err != nil {
+			return err
+		}
+		cli = c
+		return nil
+	}
+
+	c, err := makeConn(u)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	cli = &minioStorage{c}
+	return nil
+}
 
+func makeConn(u *url.URL) (*minio.Client, error) {
 	var aKey, sKey string
 	if u.User != nil {
 		aKey = u.User.Username()
@@ -45,49 +67,95 @@ func makeConn(addr string) (*minio.Client, error) {
 }
 
 func Put(b, o string, r io.Reader) error {
-	//_, err := cli.PutObject(b, o, r, -1, minio.PutObjectOptions{})
-	_, err := cli.PutObject(b, o, r, "")
-	return err
+	return cli.Put(b, o, r)
 }
 
 func Get(b, o string) (io.ReadCloser, error) {
-	//return cli.GetObject(b, o, minio.GetObjectOptions{})
-	return cli.GetObject(b, o)
+	return cli.Get(b, o)
 }
 
 func Del(b, o string) error {
-	return cli.RemoveObject(b, o)
+	return cli.Del(b, o)
 }
 
 func Make(b string) error {
-	ok, err := cli.BucketExists(b)
+	return cli.Make(b)
+}
+
+func Copy(bDst, oDst, bSrc, oSrc string) error {
+	return cli.Copy(bDst, oDst, bSrc, oSrc)
+}
+
+// List returns first n objects of bucket in lexical order
+func List(b string, n int) ([]string, error) {
+	return cli.Scan(b, "", false, n)
+}
+
+// Scan returns first n objects with prefix in lexical order, subdirectories
+// are returned as names with trailing "/" unless deep (recursive) is set
+func Scan(b, prefix string, deep bool, n int) ([]string, error) {
+	return cli.Scan(b, prefix, deep, n)
+}
+
+// Walk calls f with all objects with prefix (recursive) in lexical order
+// while f returns true
+func Walk(b, prefix string, f func(string) bool) error {
+	return cli.Walk(b, prefix, f)
+}
+
+// Stat returns time of last modification of object
+func Stat(b, o string) (time.Time, error) {
+	return cli.Stat(b, o)
+}
+
+type minioStorage struct {
+	cli *minio.Client
+}
+
+func (s *minioStorage) Put(b, o string, r io.Reader) error {
+	//_, err := s.cli.PutObject(b, o, r, -1, minio.PutObjectOptions{})
+	_, err := s.cli.PutObject(b, o, r, "")
+	return err
+}
+
+func (s *minioStorage) Get(b, o string) (io.ReadCloser, error) {
+	//return s.cli.GetObject(b, o, minio.GetObjectOptions{})
+	return s.cli.GetObject(b, o)
+}
+
+func (s *minioStorage) Del(b, o string) error {
+	return s.cli.RemoveObject(b, o)
+}
+
+func (s *minioStorage) Make(b string) error {
+	ok, err := s.cli.BucketExists(b)
 	if err != nil {
 		return err
 	}
 
 	if !ok {
-		return cli.MakeBucket(b, "")
+		return s.cli.MakeBucket(b, "")
 	}
 
 	return nil
 }
 
-func Copy(bDst, oDst, bSrc, oSrc string) error {
+func (s *minioStorage) Copy(bDst, oDst, bSrc, oSrc string) error {
 	dst, err := minio.NewDestinationInfo(bDst, oDst, nil, nil)
 	if err != nil {
 		return err
 	}
 	src := minio.NewSourceInfo(bSrc, oSrc, nil)
-	return cli.CopyObject(dst, src)
+	return s.cli.CopyObject(dst, src)
 }
 
-func List(b string, n int) ([]string, error) {
+func (s *minioStorage) Scan(b, prefix string, deep bool, n int) ([]string, error) {
 	doneCh := make(chan struct{}, 1)
 	defer func() { close(doneCh) }()
 
 	i := 0
 	out := make([]string, 0, n)
-	for o := range cli.ListObjects(b, "", false, doneCh) {
+	for o := range s.cli.ListObjects(b, prefix, deep, doneCh) {
 		if o.Err != nil {
 			return nil, o.Err
 		}
@@ -103,6 +171,30 @@ func List(b string, n int) ([]string, error) {
 	return out, nil
 }
 
+func (s *minioStorage) Walk(b, prefix string, f func(string) bool) error {
+	doneCh := make(chan struct{})
+	defer func() { close(doneCh) }()
+
+	for o := range s.cli.ListObjects(b, prefix, true, doneCh) {
+		if o.Err != nil {
+			return o.Err
+		}
+		if !f(o.Key) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *minioStorage) Stat(b, o string) (time.Time, error) {
+	i, err := s.cli.StatObject(b, o)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return i.LastModified, nil
+}
+
 func Free(o io.Closer) {
 	if o != nil {
 		_ = o.Close()
@@ -0,0 +1,623 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// diskStore is embedded key-value store (file:///path/m12.db) which
+// runs the subset of Redis commands used by m12 with the same replies,
+// so callers work with it through the same redis.Conn interface.
+// It is meant for single instance installations without Redis server:
+// the whole dataset is kept in memory (it is not an on-disk index) and
+// every write is appended to the log file (log-structured store), the log
+// is replayed on open and compacted to a snapshot of live keys when it
+// grows. Store is owned by one process, so it can't be shared by instances.
+type diskStore struct {
+	sync.Mutex
+	data map[string]*diskEntry
+
+	// versions of keys watched by connections (WATCH), a version is
+	// removed when the last connection stops watching the key
+	mods  map[string]uint64
+	watch map[string]int
+
+	keys  []string // sorted keys for SCAN (snapshot taken by new scan)
+	dirty bool     // keys were added or deleted since snapshot
+
+	path string
+	file *os.File
+	buff *bufio.Writer
+	ops  int // records since last compaction
+}
+
+type diskEntry struct {
+	kind string // string, hash, set, list, zset
+	exp  int64  // unix ms, 0 if key does not expire
+
+	str  string
+	hash map[string]string
+	set  map[string]struct{}
+	list []string
+	zset map[string]float64
+}
+
+const (
+	diskCompactMin = 100000
+	diskSyncTick   = time.Second
+	diskSweepTick  = time.Minute
+)
+
+var (
+	errWrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errSyntax    = redis.Error("ERR syntax error")
+	errNoKey     = redis.Error("ERR no such key")
+	errNotInt    = redis.Error("ERR value is not an integer or out of range")
+	errNotFloat  = redis.Error("ERR min or max is not a float")
+)
+
+func openDisk(path string) (*diskStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &diskStore{
+		data:  make(map[string]*diskEntry),
+		mods:  make(map[string]uint64),
+		watch: make(map[string]int),
+		path:  path,
+	}
+
+	err = s.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.tick()
+
+	return s, nil
+}
+
+// replay runs write commands of log file
+func (s *diskStore) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer Free(f)
+
+	r := bufio.NewReader(f)
+	for {
+		a, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Println("redis: truncated record at the end of", s.path)
+			return nil // partial write before crash
+		}
+		if err != nil {
+			return err
+		}
+		if e, ok := s.run(a, false).(redis.Error); ok {
+			return fmt.Errorf("redis: replay %s: %v", strings.Join(a, " "), e)
+		}
+	}
+}
+
+// compact rewrites log file as snapshot of live keys
+func (s *diskStore) compact() error {
+	if s.file != nil {
+		err := s.buff.Flush()
+		if err != nil {
+			return err
+		}
+		Free(s.file)
+	}
+
+	t := s.path + ".tmp"
+	f, err := os.Create(t)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	n := 0
+	now := nowMs()
+	for k, e := range s.data {
+		if e.expired(now) {
+			continue
+		}
+		for _, a := range e.dump(k) {
+			err = writeRecord(w, a)
+			if err != nil {
+				Free(f)
+				return err
+			}
+			n++
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(t, s.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.buff = bufio.NewWriter(s.file)
+	s.ops = n
+
+	return nil
+}
+
+// tick syncs log file and removes expired keys
+func (s *diskStore) tick() {
+	t := time.NewTicker(diskSyncTick)
+	last := time.Now()
+	for range t.C {
+		s.Lock()
+		err := s.buff.Flush()
+		if err == nil {
+			err = s.file.Sync()
+		}
+		if time.Since(last) > diskSweepTick {
+			now := nowMs()
+			for k, e := range s.data {
+				if e.expired(now) {
+					s.del(k)
+				}
+			}
+			last = time.Now()
+		}
+		s.Unlock()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// append writes command to log file
+func (s *diskStore) append(a ...string) {
+	err := writeRecord(s.buff, a)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.ops++
+}
+
+// flush writes buffered records to log file, compacts it when needed
+func (s *diskStore) flush() {
+	err := s.buff.Flush()
+	if err == nil && s.ops > diskCompactMin && s.ops > 2*len(s.data) {
+		err = s.compact()
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeRecord(w *bufio.Writer, a []string) error {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, uint64(len(a)))
+	_, err := w.Write(b[:n])
+	for i := 0; i < len(a) && err == nil; i++ {
+		n = binary.PutUvarint(b, uint64(len(a[i])))
+		_, err = w.Write(b[:n])
+		if err == nil {
+			_, err = w.WriteString(a[i])
+		}
+	}
+	return err
+}
+
+func readRecord(r *bufio.Reader) ([]string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	a := make([]string, n)
+	for i := range a {
+		l, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		a[i] = string(b)
+	}
+
+	return a, nil
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (e *diskEntry) expired(now int64) bool {
+	return e.exp != 0 && e.exp <= now
+}
+
+// dump returns write commands which make the entry
+func (e *diskEntry) dump(k string) [][]string {
+	var out [][]string
+	switch e.kind {
+	case "string":
+		out = append(out, []string{"SET", k, e.str})
+	case "hash":
+		a := []string{"HSET", k}
+		for f, v := range e.hash {
+			a = append(a, f, v)
+		}
+		out = append(out, a)
+	case "set":
+		a := []string{"SADD", k}
+		for m := range e.set {
+			a = append(a, m)
+		}
+		out = append(out, a)
+	case "list":
+		out = append(out, append([]string{"RPUSH", k}, e.list...))
+	case "zset":
+		a := []string{"ZADD", k}
+		for m, v := range e.zset {
+			a = append(a, formatFloat(v), m)
+		}
+		out = append(out, a)
+	}
+	if e.exp != 0 {
+		out = append(out, []string{"PEXPIREAT", k, strconv.FormatInt(e.exp, 10)})
+	}
+	return out
+}
+
+// get returns live entry of key (nil if none)
+func (s *diskStore) get(k string) *diskEntry {
+	e, ok := s.data[k]
+	if !ok {
+		return nil
+	}
+	if e.expired(nowMs()) {
+		s.del(k)
+		return nil
+	}
+	return e
+}
+
+// make returns entry of key of kind (new if none)
+func (s *diskStore) make(k, kind string) (*diskEntry, error) {
+	e := s.get(k)
+	if e != nil {
+		if e.kind != kind {
+			return nil, errWrongType
+		}
+		return e, nil
+	}
+
+	e = &diskEntry{kind: kind}
+	switch kind {
+	case "hash":
+		e.hash = make(map[string]string)
+	case "set":
+		e.set = make(map[string]struct{})
+	case "zset":
+		e.zset = make(map[string]float64)
+	}
+	s.data[k] = e
+	s.dirty = true
+
+	return e, nil
+}
+
+// kind returns live entry of key of kind (nil if none)
+func (s *diskStore) kind(k, kind string) (*diskEntry, error) {
+	e := s.get(k)
+	if e != nil && e.kind != kind {
+		return nil, errWrongType
+	}
+	return e, nil
+}
+
+func (s *diskStore) del(k string) bool {
+	if _, ok := s.data[k]; !ok {
+		return false
+	}
+	delete(s.data, k)
+	s.mod(k)
+	s.dirty = true
+	return true
+}
+
+// touch marks key as changed and removes it if it became empty
+func (s *diskStore) touch(k string) {
+	s.mod(k)
+	e, ok := s.data[k]
+	if !ok {
+		return
+	}
+	switch {
+	case e.kind == "hash" && len(e.hash) == 0,
+		e.kind == "set" && len(e.set) == 0,
+		e.kind == "list" && len(e.list) == 0,
+		e.kind == "zset" && len(e.zset) == 0:
+		s.del(k)
+	}
+}
+
+// mod changes version of key if it is watched
+func (s *diskStore) mod(k string) {
+	if s.watch[k] > 0 {
+		s.mods[k]++
+	}
+}
+
+// watched starts watching of key and returns its version
+func (s *diskStore) watched(k string) uint64 {
+	s.watch[k]++
+	return s.mods[k]
+}
+
+// unwatched stops watching of keys and drops versions of keys nobody watches
+func (s *diskStore) unwatched(w map[string]uint64) {
+	for k := range w {
+		s.watch[k]--
+		if s.watch[k] <= 0 {
+			delete(s.watch, k)
+			delete(s.mods, k)
+		}
+	}
+}
+
+// sortedKeys returns sorted keys, snapshot is taken again by new scan
+// only (fresh), so writes during scan do not re-sort all keys: deleted keys
+// are skipped by caller and keys added after start of scan may be missed
+// as by Redis SCAN
+func (s *diskStore) sortedKeys(fresh bool) []string {
+	if (fresh && s.dirty) || s.keys == nil {
+		s.keys = make([]string, 0, len(s.data))
+		for k := range s.data {
+			s.keys = append(s.keys, k)
+		}
+		sort.Strings(s.keys)
+		s.dirty = false
+	}
+	return s.keys
+}
+
+// diskConn is connection to diskStore (as redis.Conn of pool)
+type diskConn struct {
+	s     *diskStore
+	reply []interface{}
+	multi [][]string
+	inTx  bool
+	watch map[string]uint64
+}
+
+func (s *diskStore) conn() redis.Conn {
+	return &diskConn{s: s}
+}
+
+func (c *diskConn) Close() error {
+	c.unwatch()
+	c.reply, c.multi, c.inTx = nil, nil, false
+	return nil
+}
+
+func (c *diskConn) unwatch() {
+	if c.watch == nil {
+		return
+	}
+	c.s.Lock()
+	c.s.unwatched(c.watch)
+	c.s.Unlock()
+	c.watch = nil
+}
+
+func (c *diskConn) Err() error {
+	return nil
+}
+
+func (c *diskConn) Send(cmd string, args ...interface{}) error {
+	a, err := makeArgs(cmd, args)
+	if err != nil {
+		return err
+	}
+	c.reply = append(c.reply, c.exec(a))
+	return nil
+}
+
+func (c *diskConn) Flush() error {
+	return nil
+}
+
+func (c *diskConn) Receive() (interface{}, error) {
+	if len(c.reply) == 0 {
+		return nil, errors.New("redis: no pending reply")
+	}
+	r := c.reply[0]
+	c.reply = c.reply[1:]
+	if e, ok := r.(redis.Error); ok {
+		return nil, e
+	}
+	return r, nil
+}
+
+// Do works as the one of redigo: "" returns all pending replies,
+// otherwise reply of the command and the first error of pending replies
+func (c *diskConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		r := c.reply
+		c.reply = nil
+		return r, nil
+	}
+
+	err := c.Send(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := c.reply
+	c.reply = nil
+	for i := range r {
+		if e, ok := r[i].(redis.Error); ok {
+			err = e
+			break
+		}
+	}
+
+	return r[len(r)-1], err
+}
+
+func (c *diskConn) exec(a []string) interface{} {
+	switch cmd := strings.ToUpper(a[0]); {
+	case cmd == "MULTI":
+		if c.inTx {
+			return redis.Error("ERR MULTI calls can not be nested")
+		}
+		c.inTx = true
+		return "OK"
+	case cmd == "DISCARD":
+		c.unwatch()
+		c.inTx, c.multi = false, nil
+		return "OK"
+	case cmd == "EXEC":
+		return c.commit()
+	case c.inTx:
+		c.multi = append(c.multi, a)
+		return "QUEUED"
+	case cmd == "WATCH":
+		c.s.Lock()
+		if c.watch == nil {
+			c.watch = make(map[string]uint64)
+		}
+		for _, k := range a[1:] {
+			c.s.get(k) // expire
+			if _, ok := c.watch[k]; !ok {
+				c.watch[k] = c.s.watched(k)
+			}
+		}
+		c.s.Unlock()
+		return "OK"
+	case cmd == "UNWATCH":
+		c.unwatch()
+		return "OK"
+	}
+
+	c.s.Lock()
+	defer c.s.Unlock()
+	defer c.s.flush()
+
+	return c.s.run(a, true)
+}
+
+func (c *diskConn) commit() interface{} {
+	if !c.inTx {
+		return redis.Error("ERR EXEC without MULTI")
+	}
+	m, w := c.multi, c.watch
+	c.inTx, c.multi, c.watch = false, nil, nil
+
+	c.s.Lock()
+	defer c.s.Unlock()
+	defer c.s.flush()
+
+	for k := range w {
+		c.s.get(k) // expire
+	}
+	ok := true
+	for k, v := range w {
+		ok = ok && c.s.mods[k] == v
+	}
+	c.s.unwatched(w)
+	if !ok {
+		return nil
+	}
+
+	out := make([]interface{}, len(m))
+	for i := range m {
+		out[i] = c.s.run(m[i], true)
+	}
+
+	return out
+}
+
+// makeArgs converts arguments as redigo does
+func makeArgs(cmd string, args []interface{}) ([]string, error) {
+	a := make([]string, 0, len(args)+1)
+	a = append(a, cmd)
+	for _, v := range args {
+		switch v := v.(type) {
+		case string:
+			a = append(a, v)
+		case []byte:
+			a = append(a, string(v))
+		case int:
+			a = append(a, strconv.Itoa(v))
+		case int64:
+			a = append(a, strconv.FormatInt(v, 10))
+		case float64:
+			a = append(a, strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			if v {
+				a = append(a, "1")
+			} else {
+				a = append(a, "0")
+			}
+		case nil:
+			a = append(a, "")
+		case redis.Argument:
+			r, err := makeArgs("", []interface{}{v.RedisArg()})
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, r[1])
+		default:
+			a = append(a, fmt.Sprint(v))
+		}
+	}
+	return a, nil
+}
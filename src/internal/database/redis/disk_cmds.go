@@ -0,0 +1,942 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// run runs command a (name and args) and returns its reply,
+// writes are appended to log if wal is true
+func (s *diskStore) run(a []string, wal bool) interface{} {
+	cmd := strings.ToUpper(a[0])
+	f, ok := diskCmds[cmd]
+	if !ok {
+		return redis.Error(fmt.Sprintf("ERR unknown command '%s'", a[0]))
+	}
+	if len(a)-1 < f.args {
+		return redis.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", a[0]))
+	}
+
+	r, w := f.run(s, a[1:])
+	if wal && w != nil {
+		for _, v := range w {
+			s.append(v...)
+		}
+	}
+
+	return r
+}
+
+// diskCmd runs command and returns reply and records of log
+type diskCmd struct {
+	args int // min number of args
+	run  func(s *diskStore, a []string) (interface{}, [][]string)
+}
+
+var diskCmds map[string]diskCmd
+
+func init() {
+	diskCmds = map[string]diskCmd{
+		"PING":             {0, cmdPing},
+		"INFO":             {0, cmdInfo},
+		"GET":              {1, cmdGet},
+		"SET":              {2, cmdSet},
+		"DEL":              {1, cmdDel},
+		"EXISTS":           {1, cmdExists},
+		"EXPIRE":           {2, cmdExpire},
+		"PEXPIRE":          {2, cmdPexpire},
+		"PEXPIREAT":        {2, cmdPexpireat},
+		"TYPE":             {1, cmdType},
+		"RENAME":           {2, cmdRename},
+		"RENAMENX":         {2, cmdRenamenx},
+		"SCAN":             {1, cmdScan},
+		"HGET":             {2, cmdHget},
+		"HMGET":            {2, cmdHmget},
+		"HSET":             {3, cmdHset},
+		"HMSET":            {3, cmdHmset},
+		"HSETNX":           {3, cmdHsetnx},
+		"HDEL":             {2, cmdHdel},
+		"HEXISTS":          {2, cmdHexists},
+		"HGETALL":          {1, cmdHgetall},
+		"HKEYS":            {1, cmdHkeys},
+		"HLEN":             {1, cmdHlen},
+		"HSCAN":            {2, cmdHscan},
+		"SADD":             {2, cmdSadd},
+		"SREM":             {2, cmdSrem},
+		"SCARD":            {1, cmdScard},
+		"SRANDMEMBER":      {1, cmdSrandmember},
+		"LPUSH":            {2, cmdLpush},
+		"RPUSH":            {2, cmdRpush},
+		"LTRIM":            {3, cmdLtrim},
+		"LRANGE":           {3, cmdLrange},
+		"ZADD":             {3, cmdZadd},
+		"ZRANGEBYSCORE":    {3, cmdZrangebyscore},
+		"ZREMRANGEBYSCORE": {3, cmdZremrangebyscore},
+		"ZUNIONSTORE":      {3, cmdZunionstore},
+	}
+}
+
+func record(a ...string) [][]string {
+	return [][]string{a}
+}
+
+func bulks(v []string) []interface{} {
+	out := make([]interface{}, len(v))
+	for i := range v {
+		out[i] = []byte(v[i])
+	}
+	return out
+}
+
+func cmdPing(s *diskStore, a []string) (interface{}, [][]string) {
+	return "PONG", nil
+}
+
+func cmdInfo(s *diskStore, a []string) (interface{}, [][]string) {
+	return []byte(fmt.Sprintf("# Server\r\nredis_mode:embedded\r\npath:%s\r\n# Keyspace\r\nkeys:%d\r\nlog_records:%d\r\n",
+		s.path, len(s.data), s.ops)), nil
+}
+
+func cmdGet(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "string")
+	if err != nil {
+		return err, nil
+	}
+	if e == nil {
+		return nil, nil
+	}
+	return []byte(e.str), nil
+}
+
+// SET key value [EX seconds|PX milliseconds] [NX|XX]
+func cmdSet(s *diskStore, a []string) (interface{}, [][]string) {
+	var (
+		exp    int64
+		nx, xx bool
+	)
+	for i := 2; i < len(a); i++ {
+		switch o := strings.ToUpper(a[i]); {
+		case o == "NX":
+			nx = true
+		case o == "XX":
+			xx = true
+		case (o == "EX" || o == "PX") && i+1 < len(a) && exp == 0:
+			i++
+			n, err := strconv.ParseInt(a[i], 10, 64)
+			if err != nil || n <= 0 {
+				return errNotInt, nil
+			}
+			if o == "EX" {
+				n *= 1000
+			}
+			exp = nowMs() + n
+		default:
+			return errSyntax, nil
+		}
+	}
+	if nx && xx {
+		return errSyntax, nil
+	}
+	if nx && s.get(a[0]) != nil || xx && s.get(a[0]) == nil {
+		return nil, nil
+	}
+
+	s.del(a[0])
+	e, _ := s.make(a[0], "string")
+	e.str = a[1]
+	e.exp = exp
+	s.touch(a[0])
+
+	w := record("SET", a[0], a[1])
+	if exp != 0 {
+		w = append(w, []string{"PEXPIREAT", a[0], strconv.FormatInt(exp, 10)})
+	}
+	return "OK", w
+}
+
+func cmdDel(s *diskStore, a []string) (interface{}, [][]string) {
+	var n int64
+	for _, k := range a {
+		if s.get(k) != nil && s.del(k) {
+			n++
+		}
+	}
+	if n == 0 {
+		return n, nil
+	}
+	return n, record(append([]string{"DEL"}, a...)...)
+}
+
+func cmdExists(s *diskStore, a []string) (interface{}, [][]string) {
+	var n int64
+	for _, k := range a {
+		if s.get(k) != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func cmdExpire(s *diskStore, a []string) (interface{}, [][]string) {
+	n, err := strconv.ParseInt(a[1], 10, 64)
+	if err != nil {
+		return errNotInt, nil
+	}
+	return cmdPexpireat(s, []string{a[0], strconv.FormatInt(nowMs()+n*1000, 10)})
+}
+
+func cmdPexpire(s *diskStore, a []string) (interface{}, [][]string) {
+	n, err := strconv.ParseInt(a[1], 10, 64)
+	if err != nil {
+		return errNotInt, nil
+	}
+	return cmdPexpireat(s, []string{a[0], strconv.FormatInt(nowMs()+n, 10)})
+}
+
+func cmdPexpireat(s *diskStore, a []string) (interface{}, [][]string) {
+	t, err := strconv.ParseInt(a[1], 10, 64)
+	if err != nil {
+		return errNotInt, nil
+	}
+
+	e := s.get(a[0])
+	if e == nil {
+		return int64(0), nil
+	}
+
+	e.exp = t
+	s.touch(a[0])
+	s.get(a[0]) // expire at once if t is in the past
+
+	return int64(1), record("PEXPIREAT", a[0], a[1])
+}
+
+func cmdType(s *diskStore, a []string) (interface{}, [][]string) {
+	e := s.get(a[0])
+	if e == nil {
+		return "none", nil
+	}
+	return e.kind, nil
+}
+
+func cmdRename(s *diskStore, a []string) (interface{}, [][]string) {
+	e := s.get(a[0])
+	if e == nil {
+		return errNoKey, nil
+	}
+	if a[0] == a[1] {
+		return "OK", nil
+	}
+
+	s.del(a[0])
+	s.del(a[1])
+	s.data[a[1]] = e
+	s.touch(a[1])
+	s.dirty = true
+
+	return "OK", record("RENAME", a[0], a[1])
+}
+
+func cmdRenamenx(s *diskStore, a []string) (interface{}, [][]string) {
+	e := s.get(a[0])
+	if e == nil {
+		return errNoKey, nil
+	}
+	if s.get(a[1]) != nil {
+		return int64(0), nil
+	}
+
+	s.del(a[0])
+	s.data[a[1]] = e
+	s.touch(a[1])
+	s.dirty = true
+
+	return int64(1), record("RENAMENX", a[0], a[1])
+}
+
+// scanOpts parses [MATCH pattern] [COUNT count] of SCAN and HSCAN
+func scanOpts(a []string) (string, int, error) {
+	match, count := "*", 10
+	for i := 0; i < len(a); i += 2 {
+		if i+1 == len(a) {
+			return "", 0, errSyntax
+		}
+		switch strings.ToUpper(a[i]) {
+		case "MATCH":
+			match = a[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(a[i+1])
+			if err != nil || n <= 0 {
+				return "", 0, errNotInt
+			}
+			count = n
+		default:
+			return "", 0, errSyntax
+		}
+	}
+	return match, count, nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count], cursor is opaque ("0" is start and end),
+// it keeps the last returned key, so keys are returned in lexical order
+func cmdScan(s *diskStore, a []string) (interface{}, [][]string) {
+	match, count, err := scanOpts(a[1:])
+	if err != nil {
+		return err, nil
+	}
+
+	keys := s.sortedKeys(a[0] == "0")
+	i := 0
+	if a[0] != "0" {
+		if !strings.HasPrefix(a[0], "k") {
+			return redis.Error("ERR invalid cursor"), nil
+		}
+		last := a[0][1:]
+		i = sort.Search(len(keys), func(j int) bool { return keys[j] > last })
+	}
+
+	out := []string{}
+	now := nowMs()
+	for ; i < len(keys) && count > 0; i, count = i+1, count-1 {
+		e, ok := s.data[keys[i]]
+		if ok && !e.expired(now) && matchGlob(match, keys[i]) {
+			out = append(out, keys[i])
+		}
+	}
+
+	cur := "0"
+	if i < len(keys) {
+		cur = "k" + keys[i-1]
+	}
+
+	return []interface{}{[]byte(cur), bulks(out)}, nil
+}
+
+func cmdHget(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	if e == nil {
+		return nil, nil
+	}
+	v, ok := e.hash[a[1]]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(v), nil
+}
+
+func cmdHmget(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	out := make([]interface{}, len(a)-1)
+	if e == nil {
+		return out, nil
+	}
+	for i, f := range a[1:] {
+		if v, ok := e.hash[f]; ok {
+			out[i] = []byte(v)
+		}
+	}
+	return out, nil
+}
+
+func cmdHset(s *diskStore, a []string) (interface{}, [][]string) {
+	if len(a)%2 != 1 {
+		return redis.Error("ERR wrong number of arguments for 'hset' command"), nil
+	}
+	e, err := s.make(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	var n int64
+	for i := 1; i < len(a); i += 2 {
+		if _, ok := e.hash[a[i]]; !ok {
+			n++
+		}
+		e.hash[a[i]] = a[i+1]
+	}
+	s.touch(a[0])
+	return n, record(append([]string{"HSET"}, a...)...)
+}
+
+func cmdHmset(s *diskStore, a []string) (interface{}, [][]string) {
+	r, w := cmdHset(s, a)
+	if _, ok := r.(redis.Error); ok {
+		return r, w
+	}
+	return "OK", w
+}
+
+func cmdHsetnx(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.make(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	if _, ok := e.hash[a[1]]; ok {
+		return int64(0), nil
+	}
+	e.hash[a[1]] = a[2]
+	s.touch(a[0])
+	return int64(1), record("HSET", a[0], a[1], a[2])
+}
+
+func cmdHdel(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil || e == nil {
+		return zeroOr(err), nil
+	}
+	var n int64
+	for _, f := range a[1:] {
+		if _, ok := e.hash[f]; ok {
+			delete(e.hash, f)
+			n++
+		}
+	}
+	if n == 0 {
+		return n, nil
+	}
+	s.touch(a[0])
+	return n, record(append([]string{"HDEL"}, a...)...)
+}
+
+func zeroOr(err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return int64(0)
+}
+
+func cmdHexists(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil || e == nil {
+		return zeroOr(err), nil
+	}
+	if _, ok := e.hash[a[1]]; ok {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+func cmdHgetall(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	out := []interface{}{}
+	if e == nil {
+		return out, nil
+	}
+	for f, v := range e.hash {
+		out = append(out, []byte(f), []byte(v))
+	}
+	return out, nil
+}
+
+func cmdHkeys(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	out := []interface{}{}
+	if e == nil {
+		return out, nil
+	}
+	for f := range e.hash {
+		out = append(out, []byte(f))
+	}
+	return out, nil
+}
+
+func cmdHlen(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "hash")
+	if err != nil || e == nil {
+		return zeroOr(err), nil
+	}
+	return int64(len(e.hash)), nil
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count] returns all fields at once
+// (as Redis does for small hashes, COUNT is a hint)
+func cmdHscan(s *diskStore, a []string) (interface{}, [][]string) {
+	match, _, err := scanOpts(a[2:])
+	if err != nil {
+		return err, nil
+	}
+	e, err := s.kind(a[0], "hash")
+	if err != nil {
+		return err, nil
+	}
+	out := []interface{}{}
+	if e != nil && a[1] == "0" {
+		for f, v := range e.hash {
+			if matchGlob(match, f) {
+				out = append(out, []byte(f), []byte(v))
+			}
+		}
+	}
+	return []interface{}{[]byte("0"), out}, nil
+}
+
+func cmdSadd(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.make(a[0], "set")
+	if err != nil {
+		return err, nil
+	}
+	var n int64
+	for _, m := range a[1:] {
+		if _, ok := e.set[m]; !ok {
+			e.set[m] = struct{}{}
+			n++
+		}
+	}
+	s.touch(a[0])
+	if n == 0 {
+		return n, nil
+	}
+	return n, record(append([]string{"SADD"}, a...)...)
+}
+
+func cmdSrem(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "set")
+	if err != nil || e == nil {
+		return zeroOr(err), nil
+	}
+	var n int64
+	for _, m := range a[1:] {
+		if _, ok := e.set[m]; ok {
+			delete(e.set, m)
+			n++
+		}
+	}
+	if n == 0 {
+		return n, nil
+	}
+	s.touch(a[0])
+	return n, record(append([]string{"SREM"}, a...)...)
+}
+
+func cmdScard(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "set")
+	if err != nil || e == nil {
+		return zeroOr(err), nil
+	}
+	return int64(len(e.set)), nil
+}
+
+// SRANDMEMBER key [count] (count > 0: distinct members)
+func cmdSrandmember(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "set")
+	if err != nil {
+		return err, nil
+	}
+
+	n := 1
+	if len(a) > 1 {
+		n, err = strconv.Atoi(a[1])
+		if err != nil || n < 0 {
+			return errNotInt, nil
+		}
+	}
+
+	var out []string
+	if e != nil {
+		all := make([]string, 0, len(e.set))
+		for m := range e.set {
+			all = append(all, m)
+		}
+		for i, j := range rand.Perm(len(all)) {
+			if i == n {
+				break
+			}
+			out = append(out, all[j])
+		}
+	}
+
+	if len(a) == 1 {
+		if len(out) == 0 {
+			return nil, nil
+		}
+		return []byte(out[0]), nil
+	}
+
+	return bulks(out), nil
+}
+
+func cmdLpush(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.make(a[0], "list")
+	if err != nil {
+		return err, nil
+	}
+	for _, v := range a[1:] {
+		e.list = append([]string{v}, e.list...)
+	}
+	s.touch(a[0])
+	return int64(len(e.list)), record(append([]string{"LPUSH"}, a...)...)
+}
+
+func cmdRpush(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.make(a[0], "list")
+	if err != nil {
+		return err, nil
+	}
+	e.list = append(e.list, a[1:]...)
+	s.touch(a[0])
+	return int64(len(e.list)), record(append([]string{"RPUSH"}, a...)...)
+}
+
+// listRange returns [i, j) of list of n elements by Redis start and stop
+func listRange(n int, start, stop string) (int, int, error) {
+	i, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, errNotInt
+	}
+	j, err := strconv.Atoi(stop)
+	if err != nil {
+		return 0, 0, errNotInt
+	}
+	if i < 0 {
+		i += n
+	}
+	if j < 0 {
+		j += n
+	}
+	if i < 0 {
+		i = 0
+	}
+	if j >= n {
+		j = n - 1
+	}
+	if i > j {
+		return 0, 0, nil
+	}
+	return i, j + 1, nil
+}
+
+func cmdLtrim(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "list")
+	if err != nil {
+		return err, nil
+	}
+	if e == nil {
+		return "OK", nil
+	}
+	i, j, err := listRange(len(e.list), a[1], a[2])
+	if err != nil {
+		return err, nil
+	}
+	e.list = append([]string(nil), e.list[i:j]...)
+	s.touch(a[0])
+	return "OK", record("LTRIM", a[0], a[1], a[2])
+}
+
+func cmdLrange(s *diskStore, a []string) (interface{}, [][]string) {
+	e, err := s.kind(a[0], "list")
+	if err != nil {
+		return err, nil
+	}
+	if e == nil {
+		return []interface{}{}, nil
+	}
+	i, j, err := listRange(len(e.list), a[1], a[2])
+	if err != nil {
+		return err, nil
+	}
+	return bulks(e.list[i:j]), nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', 17, 64)
+}
+
+func parseFloat(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func cmdZadd(s *diskStore, a []string) (interface{}, [][]string) {
+	if len(a)%2 != 1 {
+		return errSyntax, nil
+	}
+	v := make([]float64, 0, len(a)/2)
+	for i := 1; i < len(a); i += 2 {
+		f, err := parseFloat(a[i])
+		if err != nil {
+			return redis.Error("ERR value is not a valid float"), nil
+		}
+		v = append(v, f)
+	}
+
+	e, err := s.make(a[0], "zset")
+	if err != nil {
+		return err, nil
+	}
+	var n int64
+	for i := 1; i < len(a); i += 2 {
+		if _, ok := e.zset[a[i+1]]; !ok {
+			n++
+		}
+		e.zset[a[i+1]] = v[i/2]
+	}
+	s.touch(a[0])
+	return n, record(append([]string{"ZADD"}, a...)...)
+}
+
+type zsetItem struct {
+	m string
+	v float64
+}
+
+type zsetByScore []zsetItem
+
+func (z zsetByScore) Len() int      { return len(z) }
+func (z zsetByScore) Swap(i, j int) { z[i], z[j] = z[j], z[i] }
+func (z zsetByScore) Less(i, j int) bool {
+	if z[i].v != z[j].v {
+		return z[i].v < z[j].v
+	}
+	return z[i].m < z[j].m
+}
+
+// scoreRange returns test of score by Redis min and max ("(" is exclusive)
+func scoreRange(min, max string) (func(float64) bool, error) {
+	lo, loX := strings.TrimPrefix(min, "("), strings.HasPrefix(min, "(")
+	hi, hiX := strings.TrimPrefix(max, "("), strings.HasPrefix(max, "(")
+	l, err := parseFloat(lo)
+	if err != nil {
+		return nil, errNotFloat
+	}
+	h, err := parseFloat(hi)
+	if err != nil {
+		return nil, errNotFloat
+	}
+	return func(v float64) bool {
+		return (v > l || !loX && v == l) && (v < h || !hiX && v == h)
+	}, nil
+}
+
+func (e *diskEntry) zrange(in func(float64) bool) []zsetItem {
+	var out []zsetItem
+	for m, v := range e.zset {
+		if in(v) {
+			out = append(out, zsetItem{m, v})
+		}
+	}
+	sort.Sort(zsetByScore(out))
+	return out
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func cmdZrangebyscore(s *diskStore, a []string) (interface{}, [][]string) {
+	in, err := scoreRange(a[1], a[2])
+	if err != nil {
+		return err, nil
+	}
+
+	scores, off, cnt := false, 0, -1
+	for i := 3; i < len(a); i++ {
+		switch {
+		case strings.EqualFold(a[i], "WITHSCORES"):
+			scores = true
+		case strings.EqualFold(a[i], "LIMIT") && i+2 < len(a):
+			off, err = strconv.Atoi(a[i+1])
+			if err == nil {
+				cnt, err = strconv.Atoi(a[i+2])
+			}
+			if err != nil {
+				return errNotInt, nil
+			}
+			i += 2
+		default:
+			return errSyntax, nil
+		}
+	}
+
+	e, err := s.kind(a[0], "zset")
+	if err != nil {
+		return err, nil
+	}
+	out := []interface{}{}
+	if e == nil {
+		return out, nil
+	}
+
+	z := e.zrange(in)
+	if off > len(z) || off < 0 {
+		off = len(z)
+	}
+	z = z[off:]
+	if cnt >= 0 && cnt < len(z) {
+		z = z[:cnt]
+	}
+	for _, v := range z {
+		out = append(out, []byte(v.m))
+		if scores {
+			out = append(out, []byte(formatFloat(v.v)))
+		}
+	}
+
+	return out, nil
+}
+
+func cmdZremrangebyscore(s *diskStore, a []string) (interface{}, [][]string) {
+	in, err := scoreRange(a[1], a[2])
+	if err != nil {
+		return err, nil
+	}
+	e, err := s.kind(a[0], "zset")
+	if err != nil || e == nil {
+		return zeroOr(err), nil
+	}
+
+	var n int64
+	for m, v := range e.zset {
+		if in(v) {
+			delete(e.zset, m)
+			n++
+		}
+	}
+	if n == 0 {
+		return n, nil
+	}
+	s.touch(a[0])
+	return n, record("ZREMRANGEBYSCORE", a[0], a[1], a[2])
+}
+
+// ZUNIONSTORE dst numkeys key [key ...] [AGGREGATE SUM|MIN|MAX] (no WEIGHTS)
+func cmdZunionstore(s *diskStore, a []string) (interface{}, [][]string) {
+	n, err := strconv.Atoi(a[1])
+	if err != nil || n <= 0 || len(a) < 2+n {
+		return errSyntax, nil
+	}
+
+	agg := "SUM"
+	opts := a[2+n:]
+	switch {
+	case len(opts) == 2 && strings.EqualFold(opts[0], "AGGREGATE"):
+		agg = strings.ToUpper(opts[1])
+		if agg != "SUM" && agg != "MIN" && agg != "MAX" {
+			return errSyntax, nil
+		}
+	case len(opts) != 0:
+		return errSyntax, nil
+	}
+
+	sum := make(map[string]float64)
+	for _, k := range a[2 : 2+n] {
+		e, err := s.kind(k, "zset")
+		if err != nil {
+			return err, nil
+		}
+		if e == nil {
+			continue
+		}
+		for m, v := range e.zset {
+			o, ok := sum[m]
+			switch {
+			case !ok:
+				sum[m] = v
+			case agg == "SUM":
+				sum[m] = o + v
+			case agg == "MIN":
+				sum[m] = math.Min(o, v)
+			case agg == "MAX":
+				sum[m] = math.Max(o, v)
+			}
+		}
+	}
+
+	s.del(a[0])
+	w := record("DEL", a[0])
+	if len(sum) == 0 {
+		return int64(0), w
+	}
+
+	e, _ := s.make(a[0], "zset")
+	z := []string{"ZADD", a[0]}
+	for m, v := range sum {
+		e.zset[m] = v
+		z = append(z, formatFloat(v), m)
+	}
+	s.touch(a[0])
+
+	return int64(len(sum)), append(w, z)
+}
+
+// matchGlob matches s by Redis glob pattern p (*, ?, [...], \x)
+func matchGlob(p, s string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(p, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			j := strings.IndexByte(p[1:], ']')
+			if j < 0 {
+				return p == s
+			}
+			set, neg := p[1:j+1], false
+			if strings.HasPrefix(set, "^") {
+				set, neg = set[1:], true
+			}
+			ok := false
+			for i := 0; i < len(set); i++ {
+				if i+2 < len(set) && set[i+1] == '-' {
+					if set[i] <= s[0] && s[0] <= set[i+2] {
+						ok = true
+					}
+					i += 2
+				} else if set[i] == s[0] {
+					ok = true
+				}
+			}
+			if ok == neg {
+				return false
+			}
+			p, s = p[j+2:], s[1:]
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || p[0] != s[0] {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,288 @@
+package redis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func testDisk(t *testing.T) (*diskStore, func()) {
+	d, err := ioutil.TempDir("", "m12-redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openDisk(filepath.Join(d, "m12.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { _ = os.RemoveAll(d) }
+}
+
+func TestDiskWatchMulti(t *testing.T) {
+	s, done := testDisk(t)
+	defer done()
+
+	c1, c2 := s.conn(), s.conn()
+	defer Free(c1)
+	defer Free(c2)
+
+	_, err := c1.Do("SET", "k", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// untouched key: transaction runs
+	_, _ = c1.Do("WATCH", "k")
+	_ = c1.Send("MULTI")
+	_ = c1.Send("SET", "k", "2")
+	r, err := c1.Do("EXEC")
+	if err != nil || r == nil {
+		t.Fatalf("EXEC: %v %v", r, err)
+	}
+
+	// key changed by another connection: transaction is aborted
+	_, _ = c1.Do("WATCH", "k")
+	_, _ = c2.Do("SET", "k", "3")
+	_ = c1.Send("MULTI")
+	_ = c1.Send("SET", "k", "4")
+	r, err = c1.Do("EXEC")
+	if err != nil || r != nil {
+		t.Fatalf("EXEC of changed key: %v %v", r, err)
+	}
+
+	v, _ := redis.String(c1.Do("GET", "k"))
+	if v != "3" {
+		t.Fatalf("GET: %q", v)
+	}
+
+	// missing key deleted and created again is a change too
+	_, _ = c1.Do("WATCH", "n")
+	_, _ = c2.Do("SET", "n", "1")
+	_, _ = c2.Do("DEL", "n")
+	_ = c1.Send("MULTI")
+	_ = c1.Send("SET", "n", "2")
+	r, _ = c1.Do("EXEC")
+	if r != nil {
+		t.Fatalf("EXEC of deleted key: %v", r)
+	}
+
+	// versions are dropped when nobody watches keys
+	_, _ = c1.Do("WATCH", "k", "n")
+	_, _ = c2.Do("WATCH", "k")
+	_, _ = c1.Do("UNWATCH")
+	_ = c2.Close()
+	for i := 0; i < 10; i++ {
+		_, _ = c2.Do("SET", "x"+strconv.Itoa(i), "1")
+		_, _ = c2.Do("DEL", "x"+strconv.Itoa(i))
+	}
+	if len(s.mods) != 0 || len(s.watch) != 0 {
+		t.Fatalf("versions leak: %v %v", s.mods, s.watch)
+	}
+}
+
+func TestDiskTTL(t *testing.T) {
+	s, done := testDisk(t)
+	defer done()
+
+	c := s.conn()
+	defer Free(c)
+
+	ok, err := redis.String(c.Do("SET", "a", "1", "PX", 50, "NX"))
+	if err != nil || ok != "OK" {
+		t.Fatalf("SET NX: %q %v", ok, err)
+	}
+	r, err := c.Do("SET", "a", "2", "NX")
+	if err != nil || r != nil {
+		t.Fatalf("SET NX of existing key: %v %v", r, err)
+	}
+	r, err = c.Do("SET", "b", "2", "XX")
+	if err != nil || r != nil {
+		t.Fatalf("SET XX of missing key: %v %v", r, err)
+	}
+
+	_, _ = c.Do("HSET", "h", "f", "v")
+	n, err := redis.Int(c.Do("PEXPIRE", "h", 50))
+	if err != nil || n != 1 {
+		t.Fatalf("PEXPIRE: %d %v", n, err)
+	}
+	n, _ = redis.Int(c.Do("EXPIRE", "missing", 1))
+	if n != 0 {
+		t.Fatalf("EXPIRE of missing key: %d", n)
+	}
+	_, _ = c.Do("SET", "c", "3", "EX", 60)
+
+	time.Sleep(100 * time.Millisecond)
+
+	n, _ = redis.Int(c.Do("EXISTS", "a"))
+	if n != 0 {
+		t.Fatal("SET PX: key has not expired")
+	}
+	n, _ = redis.Int(c.Do("HLEN", "h"))
+	if n != 0 {
+		t.Fatal("PEXPIRE: key has not expired")
+	}
+	v, _ := redis.String(c.Do("GET", "c"))
+	if v != "3" {
+		t.Fatalf("SET EX: %q", v)
+	}
+
+	ok, _ = redis.String(c.Do("SET", "a", "4", "PX", 1000, "NX"))
+	if ok != "OK" {
+		t.Fatal("SET NX of expired key")
+	}
+}
+
+func TestDiskScan(t *testing.T) {
+	s, done := testDisk(t)
+	defer done()
+
+	c := s.conn()
+	defer Free(c)
+
+	want := []string{}
+	for i := 0; i < 95; i++ {
+		k := "p:" + strconv.Itoa(i)
+		_, _ = c.Do("SET", k, "1")
+		_, _ = c.Do("SET", "q:"+strconv.Itoa(i), "1")
+		want = append(want, k)
+	}
+	sort.Strings(want)
+
+	got := []string{}
+	cur := "0"
+	for i := 0; ; i++ {
+		r, err := redis.Values(c.Do("SCAN", cur, "MATCH", "p:*", "COUNT", 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, _ = redis.String(r[0], nil)
+		keys, _ := redis.Strings(r[1], nil)
+		got = append(got, keys...)
+
+		// writes during scan: keys present all the time are returned
+		_, _ = c.Do("SET", "q:new"+strconv.Itoa(i), "1")
+		_, _ = c.Do("DEL", "q:"+strconv.Itoa(i))
+
+		if cur == "0" {
+			break
+		}
+	}
+
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SCAN: %d keys, want %d", len(got), len(want))
+	}
+}
+
+func TestDiskZrangebyscore(t *testing.T) {
+	s, done := testDisk(t)
+	defer done()
+
+	c := s.conn()
+	defer Free(c)
+
+	_, err := c.Do("ZADD", "z", 3, "c", 1, "a", 2, "b", 2, "bb", 5, "e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []interface{}
+		want []string
+	}{
+		{[]interface{}{"-inf", "+inf"}, []string{"a", "b", "bb", "c", "e"}},
+		{[]interface{}{2, 3}, []string{"b", "bb", "c"}},
+		{[]interface{}{"(2", 5}, []string{"c", "e"}},
+		{[]interface{}{"-inf", "(3", "LIMIT", 1, 2}, []string{"b", "bb"}},
+		{[]interface{}{6, "+inf"}, []string{}},
+	}
+	for _, v := range tests {
+		got, err := redis.Strings(c.Do("ZRANGEBYSCORE", append([]interface{}{"z"}, v.args...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("ZRANGEBYSCORE %v: %v, want %v", v.args, got, v.want)
+		}
+	}
+
+	r, err := redis.Values(c.Do("ZRANGEBYSCORE", "z", 1, 2, "WITHSCORES"))
+	if err != nil || len(r) != 6 {
+		t.Fatalf("ZRANGEBYSCORE WITHSCORES: %v %v", r, err)
+	}
+
+	n, _ := redis.Int(c.Do("ZREMRANGEBYSCORE", "z", "-inf", 2))
+	if n != 3 {
+		t.Fatalf("ZREMRANGEBYSCORE: %d", n)
+	}
+}
+
+func TestDiskReplay(t *testing.T) {
+	s, done := testDisk(t)
+	defer done()
+
+	c := s.conn()
+	_, _ = c.Do("HMSET", "h", "a", "1", "b", "2")
+	_, _ = c.Do("HDEL", "h", "a")
+	_, _ = c.Do("SET", "gone", "1", "PX", 1)
+	_, _ = c.Do("RPUSH", "l", "x", "y", "z")
+	_, _ = c.Do("LTRIM", "l", 1, -1)
+	_, _ = c.Do("SADD", "s", "m", "n")
+	_, _ = c.Do("SREM", "s", "n")
+	_, _ = c.Do("SADD", "e", "m")
+	_, _ = c.Do("SREM", "e", "m")
+	_, _ = c.Do("SET", "t", "1", "EX", 60)
+	_, _ = c.Do("HSET", "r", "f", "1")
+	_, _ = c.Do("RENAME", "r", "h2")
+	Free(c)
+
+	s.Lock()
+	err := s.buff.Flush()
+	s.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	r, err := openDisk(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = r.conn()
+	defer Free(c)
+
+	h, _ := redis.StringMap(c.Do("HGETALL", "h"))
+	if !reflect.DeepEqual(h, map[string]string{"b": "2"}) {
+		t.Errorf("HGETALL: %v", h)
+	}
+	l, _ := redis.Strings(c.Do("LRANGE", "l", 0, -1))
+	if !reflect.DeepEqual(l, []string{"y", "z"}) {
+		t.Errorf("LRANGE: %v", l)
+	}
+	n, _ := redis.Int(c.Do("SCARD", "s"))
+	if n != 1 {
+		t.Errorf("SCARD: %d", n)
+	}
+	n, _ = redis.Int(c.Do("EXISTS", "gone"))
+	if n != 0 {
+		t.Error("expired key is replayed")
+	}
+	n, _ = redis.Int(c.Do("EXISTS", "e"))
+	if n != 0 {
+		t.Error("empty set is replayed")
+	}
+	h, _ = redis.StringMap(c.Do("HGETALL", "h2"))
+	if !reflect.DeepEqual(h, map[string]string{"f": "1"}) {
+		t.Errorf("RENAME: %v", h)
+	}
+	if e := r.get("t"); e == nil || e.exp == 0 {
+		t.Error("TTL is not replayed")
+	}
+}
@@ -1,9 +1,11 @@
 package redis
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net/url"
+	"path/filepath"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -11,11 +13,29 @@ import (
 
 var (
 	pool *redis.Pool
+	disk *diskStore
 )
 
-// Init inits client for REDIS Server
+// Connection represents a connection to REDIS Server
+type Connection redis.Conn
+
+// Init inits client for REDIS Server (or embedded store for file:// address)
 func Init(addr string) error {
-	p, err := makePool(addr)
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "file" {
+		d, err := makeDisk(u)
+		if err != nil {
+			return err
+		}
+		disk = d
+		return nil
+	}
+
+	p, err := makePool(u)
 	if err != nil {
 		return err
 	}
@@ -23,12 +43,18 @@ func Init(addr string) error {
 	return nil
 }
 
-func makePool(addr string) (*redis.Pool, error) {
-	u, err := url.Parse(addr)
-	if err != nil {
-		return nil, err
+func makeDisk(u *url.URL) (*diskStore, error) {
+	path := filepath.FromSlash(u.Path)
+	if u.Host != "" { // file://./m12.db
+		path = filepath.Join(u.Host, path)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("redis: empty path of %s", u.String())
 	}
+	return openDisk(path)
+}
 
+func makePool(u *url.URL) (*redis.Pool, error) {
 	p := &redis.Pool{
 		MaxIdle:     128,
 		IdleTimeout: 60 * time.Second,
@@ -59,6 +85,9 @@ func waitDBFromDisk(p *redis.Pool, d time.Duration) error {
 }
 
 func Conn() redis.Conn {
+	if disk != nil {
+		return disk.conn()
+	}
 	return pool.Get()
 }
 
@@ -92,6 +121,10 @@ func Bytes(v interface{}, err error) ([]byte, error) {
 	return redis.Bytes(v, err)
 }
 
+func StringMap(v interface{}, err error) (map[string]string, error) {
+	return redis.StringMap(v, err)
+}
+
 func NotErrNil(err error) bool {
 	return err != redis.ErrNil
 }
@@ -0,0 +1,115 @@
+package nats
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// memBroker delivers messages inside the process (mem://),
+// subjects support NATS wildcards: "*" is any token, ">" is the rest.
+type memBroker struct {
+	sync.Mutex
+	subs []memSub
+	next map[string]int // round robin of queue groups
+}
+
+type memSub struct {
+	subj  []string
+	queue string
+	f     func([]byte)
+}
+
+func newMem() *memBroker {
+	return &memBroker{next: make(map[string]int)}
+}
+
+func testSubject(s string, wild bool) error {
+	t := strings.Split(s, ".")
+	for i := range t {
+		switch {
+		case t[i] == "":
+			return fmt.Errorf("nats: invalid subject %s", s)
+		case !wild && (t[i] == "*" || t[i] == ">"):
+			return fmt.Errorf("nats: invalid subject %s", s)
+		case t[i] == ">" && i != len(t)-1:
+			return fmt.Errorf("nats: invalid subject %s", s)
+		}
+	}
+	return nil
+}
+
+func (b *memBroker) Subscribe(s string, f func([]byte)) error {
+	return b.QueueSubscribe(s, "", f)
+}
+
+func (b *memBroker) QueueSubscribe(s, q string, f func([]byte)) error {
+	err := testSubject(s, true)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.subs = append(b.subs, memSub{strings.Split(s, "."), q, f})
+	return nil
+}
+
+func (b *memBroker) Publish(s string, data []byte) error {
+	err := testSubject(s, false)
+	if err != nil {
+		return err
+	}
+
+	t := strings.Split(s, ".")
+	var (
+		send  []func([]byte)
+		queue = make(map[string][]func([]byte))
+		names []string // queue groups in order of subscription
+	)
+
+	b.Lock()
+	for _, v := range b.subs {
+		if !matchSubject(v.subj, t) {
+			continue
+		}
+		if v.queue == "" {
+			send = append(send, v.f)
+			continue
+		}
+		if _, ok := queue[v.queue]; !ok {
+			names = append(names, v.queue)
+		}
+		queue[v.queue] = append(queue[v.queue], v.f)
+	}
+	for _, q := range names {
+		send = append(send, queue[q][b.next[q]%len(queue[q])])
+		b.next[q]++
+	}
+	b.Unlock()
+
+	for _, f := range send {
+		// copy as NATS does, subscribers may keep or change data
+		d := make([]byte, len(data))
+		copy(d, data)
+		go f(d)
+	}
+
+	return nil
+}
+
+// matchSubject returns true if subject tokens t match pattern tokens p
+func matchSubject(p, t []string) bool {
+	for i := range p {
+		switch {
+		case p[i] == ">":
+			return len(t) > i
+		case i >= len(t):
+			return false
+		case p[i] != "*" && p[i] != t[i]:
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
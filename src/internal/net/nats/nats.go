@@ -4,30 +4,50 @@ import (
 	"crypto/tls"
 	"log"
 	"net/url"
+	"sync"
 	"time"
 
 	nats "github.com/nats-io/go-nats"
 )
 
-var cli *nats.Conn
+// broker is message broker: NATS server or in-process one
+type broker interface {
+	Subscribe(s string, f func([]byte)) error
+	QueueSubscribe(s, q string, f func([]byte)) error
+	Publish(s string, data []byte) error
+}
+
+var cli broker
 
-// Init inits client for NATS Server
+// reconnect holds functions called after connection to NATS Server is
+// restored (messages published while it was lost are not delivered)
+var reconnect struct {
+	sync.Mutex
+	f []func()
+}
+
+// Init inits client for NATS Server (or in-process broker for mem:// address)
 func Init(addr string) error {
-	c, err := makeConn(addr)
+	u, err := url.Parse(addr)
 	if err != nil {
 		return err
 	}
-	cli = c
-	return nil
-}
 
-func makeConn(addr string) (*nats.Conn, error) {
-	u, err := url.Parse(addr)
+	if u.Scheme == "mem" {
+		cli = newMem()
+		return nil
+	}
+
+	c, err := makeConn(u, addr)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	cli = &natsBroker{c}
+	return nil
+}
 
-	opts := []nats.Option{nats.MaxReconnects(-1)}
+func makeConn(u *url.URL, addr string) (*nats.Conn, error) {
+	opts := []nats.Option{nats.MaxReconnects(-1), nats.ReconnectHandler(onReconnect)}
 	if u.User != nil {
 		opts = append(opts, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
 	}
@@ -46,13 +66,58 @@ func makeConn(addr string) (*nats.Conn, error) {
 	return c, nil
 }
 
+// Subscribe calls f (in new goroutine) for each message of subject s
 func Subscribe(s string, f func([]byte)) error {
-	_, err := cli.Subscribe(s, func(m *nats.Msg) {
+	return cli.Subscribe(s, f)
+}
+
+// QueueSubscribe is Subscribe, but each message is delivered
+// to only one subscriber of queue group q
+func QueueSubscribe(s, q string, f func([]byte)) error {
+	return cli.QueueSubscribe(s, q, f)
+}
+
+func Publish(s string, data []byte) error {
+	return cli.Publish(s, data)
+}
+
+// OnReconnect calls f each time connection to NATS Server is restored
+func OnReconnect(f func()) {
+	reconnect.Lock()
+	defer reconnect.Unlock()
+
+	reconnect.f = append(reconnect.f, f)
+}
+
+func onReconnect(*nats.Conn) {
+	log.Println("nats: reconnected")
+
+	reconnect.Lock()
+	defer reconnect.Unlock()
+
+	for _, f := range reconnect.f {
+		go f()
+	}
+}
+
+type natsBroker struct {
+	cli *nats.Conn
+}
+
+func (b *natsBroker) Subscribe(s string, f func([]byte)) error {
+	_, err := b.cli.Subscribe(s, func(m *nats.Msg) {
 		go f(m.Data)
 	})
 	return err
 }
 
-func Publish(s string, data []byte) error {
-	return cli.Publish(s, data)
+func (b *natsBroker) QueueSubscribe(s, q string, f func([]byte)) error {
+	_, err := b.cli.QueueSubscribe(s, q, func(m *nats.Msg) {
+		go f(m.Data)
+	})
+	return err
+}
+
+func (b *natsBroker) Publish(s string, data []byte) error {
+	return b.cli.Publish(s, data)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -19,10 +21,32 @@ import (
 	"internal/version"
 )
 
+var commands = map[string]func([]byte) (interface{}, error){
+	"migrate":   core.Migrate,
+	"check":     core.Check,
+	"reencrypt": core.ReencryptNow,
+	"fuzz":      core.BuildFuzz,
+}
+
+// storeCommands need object storage
+var storeCommands = map[string]bool{
+	"reencrypt": true,
+	"fuzz":      true,
+}
+
 func main() {
 	pref.Init()
 	initLogger(systemdBased(), pref.Verbose)
 
+	if args := pref.Args(); len(args) > 0 {
+		err := runCommand(pref.MINIO, pref.REDIS, args[0], args[1:]...)
+		if err != nil {
+			log.Println(version.AppName(), err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := initAndRun(
 		pref.NATS,
 		pref.MINIO,
@@ -74,3 +98,46 @@ func initAndRun(addrNATS, addrMINIO, addrREDIS, addrSERVER string) error {
 
 	return server.Run(addrSERVER, api.MakeRouter())
 }
+
+// runCommand runs command with options, e.g. "migrate dry verify", "check fix" or "reencrypt dry"
+func runCommand(addrMINIO, addrREDIS, name string, opts ...string) error {
+	f, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+
+	if storeCommands[name] {
+		err := minio.Init(addrMINIO)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := redis.Init(addrREDIS)
+	if err != nil {
+		return err
+	}
+
+	o := make(map[string]bool, len(opts))
+	for i := range opts {
+		o[opts[i]] = true
+	}
+
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	res, err := f(data)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(res, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}